@@ -0,0 +1,74 @@
+package pinggy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+/*
+authMethods builds the list of ssh authentication methods for conf. Public
+keys are offered first; the password method is always kept as the last resort.
+The returned cleanup function releases the ssh-agent connection, if any, and
+must be called once the handshake is over.
+*/
+func authMethods(conf *Config) (methods []ssh.AuthMethod, cleanup func(), err error) {
+	cleanup = func() {}
+
+	signers := append([]ssh.Signer{}, conf.Signers...)
+
+	if conf.PrivateKeyFile != "" {
+		signer, err := loadPrivateKey(conf.PrivateKeyFile, conf.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		signers = append(signers, signer)
+	}
+
+	if conf.UseSshAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, cleanup, fmt.Errorf("ssh agent requested, but SSH_AUTH_SOCK is not set")
+		}
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("cannot connect to ssh agent: %v", err)
+		}
+		cleanup = func() { agentConn.Close() }
+		agentSigners, err := agent.NewClient(agentConn).Signers()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("cannot list ssh agent keys: %v", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	methods = append(methods, ssh.Password("nopass"))
+	return methods, cleanup, nil
+}
+
+func loadPrivateKey(path, passphrase string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, fmt.Errorf("private key %s is encrypted, passphrase required", path)
+		}
+		return nil, fmt.Errorf("cannot parse private key %s: %v", path, err)
+	}
+	return signer, nil
+}
@@ -0,0 +1,282 @@
+package pinggy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+/*
+writeKeyFile writes a new ecdsa key to a file, encrypted with passphrase if
+it is not empty, and returns the path and the public key.
+*/
+func writeKeyFile(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, publicKey
+}
+
+/*
+startTestAgent serves a keyring holding keys at a new SSH_AUTH_SOCK.
+*/
+func startTestAgent(t *testing.T, keys ...interface{}) {
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	setAuthSock(t, socket)
+}
+
+func setAuthSock(t *testing.T, socket string) {
+	previous, set := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("SSH_AUTH_SOCK", previous)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	})
+}
+
+/*
+offeredAuth runs a handshake with methods against a server which rejects
+every public key, and returns what the client offered, in order: the sha256
+fingerprints of the keys, then "password" and the password.
+*/
+func offeredAuth(t *testing.T, methods []ssh.AuthMethod) []string {
+	var mu sync.Mutex
+	offered := []string{}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			offered = append(offered, ssh.FingerprintSHA256(key))
+			return nil, errors.New("public key rejected")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			offered = append(offered, "password", string(password))
+			return nil, nil
+		},
+	}
+	config.AddHostKey(generateSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		conn, channels, requests, err := ssh.NewServerConn(server, config)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go ssh.DiscardRequests(requests)
+		for newChannel := range channels {
+			newChannel.Reject(ssh.Prohibited, "no channels")
+		}
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, _, _, err := ssh.NewClientConn(client, "pinggy", &ssh.ClientConfig{
+		User:            "auth",
+		Auth:            methods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]string{}, offered...)
+}
+
+func expectOffered(t *testing.T, offered []string, expected ...string) {
+	t.Helper()
+	if strings.Join(offered, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v to be offered, got %v", expected, offered)
+	}
+}
+
+func TestAuthMethodsPasswordOnly(t *testing.T) {
+	methods, cleanup, err := authMethods(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	expectOffered(t, offeredAuth(t, methods), "password", "nopass")
+}
+
+func TestAuthMethodsOrder(t *testing.T) {
+	first := generateSigner(t)
+	second := generateSigner(t)
+	keyFile, fileKey := writeKeyFile(t, "")
+	_, agentKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestAgent(t, agentKey)
+	agentSigner, err := ssh.NewSignerFromKey(agentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods, cleanup, err := authMethods(&Config{
+		Signers:        []ssh.Signer{first, second},
+		PrivateKeyFile: keyFile,
+		UseSshAgent:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	// Signers, then the key file, then the agent keys, then the password.
+	expectOffered(t, offeredAuth(t, methods),
+		ssh.FingerprintSHA256(first.PublicKey()),
+		ssh.FingerprintSHA256(second.PublicKey()),
+		ssh.FingerprintSHA256(fileKey),
+		ssh.FingerprintSHA256(agentSigner.PublicKey()),
+		"password", "nopass",
+	)
+}
+
+func TestAuthMethodsAgentErrors(t *testing.T) {
+	setAuthSock(t, "")
+	if _, _, err := authMethods(&Config{UseSshAgent: true}); err == nil || !strings.Contains(err.Error(), "SSH_AUTH_SOCK") {
+		t.Fatalf("expected an error about SSH_AUTH_SOCK, got %v", err)
+	}
+	setAuthSock(t, filepath.Join(t.TempDir(), "missing.sock"))
+	if _, _, err := authMethods(&Config{UseSshAgent: true}); err == nil || !strings.Contains(err.Error(), "cannot connect to ssh agent") {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	path, publicKey := writeKeyFile(t, "")
+	signer, err := loadPrivateKey(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(signer.PublicKey()) != ssh.FingerprintSHA256(publicKey) {
+		t.Fatal("unexpected key loaded")
+	}
+
+	_, err = loadPrivateKey(filepath.Join(t.TempDir(), "missing"), "")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file error, got %v", err)
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage")
+	if err := ioutil.WriteFile(garbage, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPrivateKey(garbage, ""); err == nil || !strings.Contains(err.Error(), "cannot parse private key") {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+}
+
+func TestLoadPrivateKeyEncrypted(t *testing.T) {
+	path, publicKey := writeKeyFile(t, "secret")
+
+	_, err := loadPrivateKey(path, "")
+	if err == nil || !strings.Contains(err.Error(), "passphrase required") {
+		t.Fatalf("expected a missing passphrase error, got %v", err)
+	}
+	if _, err := loadPrivateKey(path, "wrong"); err == nil {
+		t.Fatal("expected an error for a wrong passphrase")
+	}
+
+	signer, err := loadPrivateKey(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(signer.PublicKey()) != ssh.FingerprintSHA256(publicKey) {
+		t.Fatal("unexpected key loaded")
+	}
+
+	// The errors are returned by authMethods as well.
+	if _, _, err := authMethods(&Config{PrivateKeyFile: path}); err == nil {
+		t.Fatal("expected an error without passphrase")
+	}
+}
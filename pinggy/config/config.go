@@ -0,0 +1,435 @@
+/*
+Package config builds pinggy.Config values from YAML or JSON files and from
+PINGGY_* environment variables.
+
+A file either describes a single tunnel, or a list of tunnels under the
+`tunnels` key. Keys set at the top level act as defaults for every tunnel in
+the list:
+
+	token: my-token
+	server: a.pinggy.io:443
+	tunnels:
+	  - name: web
+	    type: http
+	    tcpForwardingAddr: localhost:8080
+	    headerManipulationAndAuth:
+	      basicAuths: ["user:password"]
+	  - name: dns
+	    altType: udp
+	    udpForwardingAddr: localhost:53
+	    ipWhiteList: ["10.0.0.0/8", "2001:db8::/32"]
+
+Values are resolved in the following order, later ones taking precedence:
+the pinggy defaults, the top level of the file, the tunnel entry and finally
+the environment variables, which apply to every tunnel.
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+A tunnel read from a config file.
+*/
+type Tunnel struct {
+	/*
+		Name of the tunnel as given in the file. It is empty for single tunnel files.
+	*/
+	Name string
+
+	Config pinggy.Config
+}
+
+/*
+A problem found while loading a config, pointing at the offending key.
+*/
+type Problem struct {
+	/*
+		Key path inside the file, e.g. `tunnels[1].ipWhiteList[0]`, or the name
+		of the environment variable the value came from.
+	*/
+	Key string
+
+	Message string
+}
+
+/*
+Error lists every problem found while loading a config.
+*/
+type Error struct {
+	/*
+		Path of the file being loaded, if any.
+	*/
+	File string
+
+	Problems []Problem
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.Key+": "+p.Message)
+	}
+	prefix := "invalid config"
+	if e.File != "" {
+		prefix += " " + e.File
+	}
+	return prefix + ": " + strings.Join(msgs, "; ")
+}
+
+func (e *Error) add(key, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+type fileHeader struct {
+	Name   string   `yaml:"name"`
+	Remove bool     `yaml:"remove"`
+	Values []string `yaml:"values"`
+}
+
+type fileHeaderManipulation struct {
+	HostName    string       `yaml:"hostName"`
+	Headers     []fileHeader `yaml:"headers"`
+	BasicAuths  []string     `yaml:"basicAuths"`
+	BearerAuths []string     `yaml:"bearerAuths"`
+}
+
+type fileTunnel struct {
+	Name                      string                  `yaml:"name"`
+	Token                     *string                 `yaml:"token"`
+	Type                      *string                 `yaml:"type"`
+	AltType                   *string                 `yaml:"altType"`
+	Server                    *string                 `yaml:"server"`
+	TcpForwardingAddr         *string                 `yaml:"tcpForwardingAddr"`
+	UdpForwardingAddr         *string                 `yaml:"udpForwardingAddr"`
+	IpWhiteList               *[]string               `yaml:"ipWhiteList"`
+	HeaderManipulationAndAuth *fileHeaderManipulation `yaml:"headerManipulationAndAuth"`
+	Timeout                   *string                 `yaml:"timeout"`
+	SshOverSsl                *bool                   `yaml:"sshOverSsl"`
+	Proxy                     *string                 `yaml:"proxy"`
+	KeepAliveInterval         *string                 `yaml:"keepAliveInterval"`
+	PrivateKeyFile            *string                 `yaml:"privateKeyFile"`
+	KnownHostsFile            *string                 `yaml:"knownHostsFile"`
+	TrustOnFirstUse           *bool                   `yaml:"trustOnFirstUse"`
+}
+
+type file struct {
+	fileTunnel `yaml:",inline"`
+	Tunnels    []fileTunnel `yaml:"tunnels"`
+}
+
+/*
+Load reads the tunnels described by a YAML or JSON file and applies the
+PINGGY_* environment variables on top of them.
+*/
+func Load(path string) ([]Tunnel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tunnels, err := parse(data, os.LookupEnv)
+	if cerr, ok := err.(*Error); ok {
+		cerr.File = path
+	}
+	return tunnels, err
+}
+
+/*
+Parse is the same as Load, but reads the file content from data.
+*/
+func Parse(data []byte) ([]Tunnel, error) {
+	return parse(data, os.LookupEnv)
+}
+
+/*
+FromEnv builds a single tunnel config from the PINGGY_* environment variables only.
+*/
+func FromEnv() (pinggy.Config, error) {
+	b := newBuilder()
+	b.applyEnv(os.LookupEnv)
+	return b.finish()
+}
+
+func parse(data []byte, lookupEnv func(string) (string, bool)) ([]Tunnel, error) {
+	var f file
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&f)
+	if err != nil && err != io.EOF {
+		return nil, &Error{Problems: []Problem{{Key: "(file)", Message: err.Error()}}}
+	}
+
+	entries := f.Tunnels
+	if len(entries) == 0 {
+		entries = []fileTunnel{{}}
+	}
+
+	cerr := &Error{}
+	seen := make(map[Problem]bool)
+	tunnels := make([]Tunnel, 0, len(entries))
+	for i, entry := range entries {
+		b := newBuilder()
+		b.apply(&f.fileTunnel, fileKey(""))
+		if len(f.Tunnels) > 0 {
+			b.apply(&entry, fileKey(fmt.Sprintf("tunnels[%d].", i)))
+		}
+		b.applyEnv(lookupEnv)
+		conf, err := b.finish()
+		if err != nil {
+			perr, ok := err.(*Error)
+			if !ok {
+				return nil, err
+			}
+			for _, p := range perr.Problems {
+				// Problems caused by the environment show up for every tunnel.
+				if !seen[p] {
+					seen[p] = true
+					cerr.Problems = append(cerr.Problems, p)
+				}
+			}
+			continue
+		}
+		tunnels = append(tunnels, Tunnel{Name: entry.Name, Config: conf})
+	}
+	if len(cerr.Problems) > 0 {
+		return nil, cerr
+	}
+	return tunnels, nil
+}
+
+func fileKey(prefix string) func(string) string {
+	return func(name string) string { return prefix + name }
+}
+
+/*
+builder accumulates a pinggy.Config and remembers where every field was taken
+from, so that validation errors can point at the right key.
+*/
+type builder struct {
+	conf pinggy.Config
+	// Keyed by field name. Parts of a field set by an environment variable,
+	// like "HeaderManipulationAndAuth.BasicAuths", have their own entry.
+	sources map[string]string
+	err     *Error
+}
+
+func newBuilder() *builder {
+	return &builder{sources: make(map[string]string), err: &Error{}}
+}
+
+func (b *builder) setString(field, key string, dst *string, val *string) {
+	if val == nil {
+		return
+	}
+	*dst = *val
+	b.sources[field] = key
+}
+
+func (b *builder) setBool(field, key string, dst *bool, val *bool) {
+	if val == nil {
+		return
+	}
+	*dst = *val
+	b.sources[field] = key
+}
+
+func (b *builder) setDuration(field, key string, dst *time.Duration, val *string) {
+	if val == nil {
+		return
+	}
+	d, err := time.ParseDuration(*val)
+	if err != nil {
+		b.err.add(key, "invalid duration %q", *val)
+		return
+	}
+	*dst = d
+	b.sources[field] = key
+}
+
+func (b *builder) setIpWhiteList(key string, cidrs []string) {
+	whiteList := make([]*net.IPNet, 0, len(cidrs))
+	for i, cidr := range cidrs {
+		ipNet, err := parseCidr(cidr)
+		if err != nil {
+			b.err.add(fmt.Sprintf("%s[%d]", key, i), "%v", err)
+			continue
+		}
+		whiteList = append(whiteList, ipNet)
+	}
+	b.conf.IpWhiteList = whiteList
+	b.sources["IpWhiteList"] = key
+}
+
+/*
+parseCidr accepts CIDRs as well as plain addresses, which are treated as a
+single host network.
+*/
+func parseCidr(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address or cidr %q", cidr)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q", cidr)
+	}
+	return ipNet, nil
+}
+
+func (b *builder) setHeaderManipulation(key string, hman *fileHeaderManipulation) {
+	conf := &pinggy.HttpHeaderManipulationAndAuthConfig{
+		HostName:    hman.HostName,
+		Headers:     make(map[string]*pinggy.PinggyHttpHeaderInfo),
+		BasicAuths:  make(map[string]bool),
+		BearerAuths: make(map[string]bool),
+	}
+	for i, header := range hman.Headers {
+		if header.Name == "" {
+			b.err.add(subKey(key, fmt.Sprintf("headers[%d].name", i)), "header name is empty")
+			continue
+		}
+		conf.Headers[header.Name] = &pinggy.PinggyHttpHeaderInfo{
+			Key:       header.Name,
+			Remove:    header.Remove,
+			NewValues: header.Values,
+		}
+	}
+	for i, auth := range hman.BasicAuths {
+		if !strings.Contains(auth, ":") {
+			b.err.add(b.headerKey(key, "BasicAuths", fmt.Sprintf("basicAuths[%d]", i)), "expected `user:password`")
+			continue
+		}
+		conf.BasicAuths[base64.StdEncoding.EncodeToString([]byte(auth))] = true
+	}
+	for _, bearer := range hman.BearerAuths {
+		conf.BearerAuths[bearer] = true
+	}
+	b.conf.HeaderManipulationAndAuth = conf
+	b.sources["HeaderManipulationAndAuth"] = key
+}
+
+/*
+headerKey is the key of a part of the header manipulation, which an
+environment variable may have replaced.
+*/
+func (b *builder) headerKey(key, part, sub string) string {
+	if envKey, ok := b.sources["HeaderManipulationAndAuth."+part]; ok {
+		return envKey
+	}
+	return subKey(key, sub)
+}
+
+// subKey points at a nested key. Environment variables have no nesting.
+func subKey(key, sub string) string {
+	if strings.HasPrefix(key, envPrefix) {
+		return key
+	}
+	return key + "." + sub
+}
+
+/*
+apply copies every value set in t. key maps the yaml name of a field to the
+key reported in errors.
+*/
+func (b *builder) apply(t *fileTunnel, key func(name string) string) {
+	conf := &b.conf
+	b.setString("Token", key("token"), &conf.Token, t.Token)
+	if t.Type != nil {
+		conf.Type = pinggy.TunnelType(strings.ToLower(*t.Type))
+		b.sources["Type"] = key("type")
+	}
+	if t.AltType != nil {
+		conf.AltType = pinggy.UDPTunnelType(strings.ToLower(*t.AltType))
+		b.sources["AltType"] = key("altType")
+	}
+	b.setString("Server", key("server"), &conf.Server, t.Server)
+	b.setString("TcpForwardingAddr", key("tcpForwardingAddr"), &conf.TcpForwardingAddr, t.TcpForwardingAddr)
+	b.setString("UdpForwardingAddr", key("udpForwardingAddr"), &conf.UdpForwardingAddr, t.UdpForwardingAddr)
+	if t.IpWhiteList != nil {
+		b.setIpWhiteList(key("ipWhiteList"), *t.IpWhiteList)
+	}
+	if t.HeaderManipulationAndAuth != nil {
+		b.setHeaderManipulation(key("headerManipulationAndAuth"), t.HeaderManipulationAndAuth)
+	}
+	b.setDuration("Timeout", key("timeout"), &conf.Timeout, t.Timeout)
+	b.setBool("SshOverSsl", key("sshOverSsl"), &conf.SshOverSsl, t.SshOverSsl)
+	b.setString("Proxy", key("proxy"), &conf.Proxy, t.Proxy)
+	b.setDuration("KeepAliveInterval", key("keepAliveInterval"), &conf.KeepAliveInterval, t.KeepAliveInterval)
+	b.setString("PrivateKeyFile", key("privateKeyFile"), &conf.PrivateKeyFile, t.PrivateKeyFile)
+	b.setString("KnownHostsFile", key("knownHostsFile"), &conf.KnownHostsFile, t.KnownHostsFile)
+	b.setBool("TrustOnFirstUse", key("trustOnFirstUse"), &conf.TrustOnFirstUse, t.TrustOnFirstUse)
+}
+
+/*
+finish validates the collected config and translates the problems reported by
+pinggy into keys of the source they came from.
+*/
+func (b *builder) finish() (pinggy.Config, error) {
+	err := b.conf.Validate()
+	if perr, ok := err.(*pinggy.ConfigError); ok {
+		for _, p := range perr.Problems {
+			b.err.add(b.keyOf(p.Field), "%s", p.Message)
+		}
+	} else if err != nil {
+		return b.conf, err
+	}
+	if len(b.err.Problems) > 0 {
+		return b.conf, b.err
+	}
+	return b.conf, nil
+}
+
+func (b *builder) keyOf(field string) string {
+	name, rest := field, ""
+	if i := strings.IndexAny(field, ".["); i >= 0 {
+		name, rest = field[:i], field[i:]
+	}
+	if strings.HasPrefix(rest, ".") {
+		part := rest[1:]
+		if i := strings.IndexAny(part, ".["); i >= 0 {
+			part = part[:i]
+		}
+		if key, ok := b.sources[name+"."+part]; ok {
+			return key
+		}
+	}
+	key, ok := b.sources[name]
+	if !ok {
+		key = lowerFirst(name)
+	}
+	if strings.HasPrefix(key, envPrefix) {
+		return key
+	}
+	// HeaderManipulationAndAuth.Headers[x] -> headerManipulationAndAuth.headers[x]
+	segments := strings.Split(rest, ".")
+	for i, segment := range segments {
+		segments[i] = lowerFirst(segment)
+	}
+	return key + strings.Join(segments, ".")
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+)
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		val, ok := env[name]
+		return val, ok
+	}
+}
+
+func TestParseTunnels(t *testing.T) {
+	data := `
+token: file-token
+server: a.pinggy.io:443
+timeout: 5s
+tunnels:
+  - name: web
+    type: http
+    tcpForwardingAddr: localhost:8080
+    headerManipulationAndAuth:
+      headers:
+        - name: X-Forwarded-Proto
+          values: [https]
+      basicAuths: ["user:password"]
+  - name: dns
+    altType: udp
+    udpForwardingAddr: localhost:53
+    ipWhiteList: ["10.0.0.0/8", "2001:db8::/32", "192.168.1.1"]
+`
+	tunnels, err := parse([]byte(data), lookupFrom(map[string]string{"PINGGY_TOKEN": "env-token"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got %d", len(tunnels))
+	}
+
+	web := tunnels[0]
+	if web.Name != "web" || web.Config.Type != pinggy.HTTP || web.Config.TcpForwardingAddr != "localhost:8080" {
+		t.Errorf("unexpected web tunnel: %+v", web)
+	}
+	if web.Config.Token != "env-token" {
+		t.Errorf("environment should take precedence, got token %q", web.Config.Token)
+	}
+	if web.Config.Timeout != 5*time.Second {
+		t.Errorf("top level default not applied, got timeout %v", web.Config.Timeout)
+	}
+	hman := web.Config.HeaderManipulationAndAuth
+	if hman == nil || hman.Headers["X-Forwarded-Proto"] == nil || !hman.BasicAuths["dXNlcjpwYXNzd29yZA=="] {
+		t.Errorf("unexpected header manipulation: %+v", hman)
+	}
+
+	dns := tunnels[1]
+	if dns.Config.AltType != pinggy.UDP || len(dns.Config.IpWhiteList) != 3 {
+		t.Errorf("unexpected dns tunnel: %+v", dns)
+	}
+	if ones, bits := dns.Config.IpWhiteList[2].Mask.Size(); ones != 32 || bits != 32 {
+		t.Errorf("plain address should become a /32, got /%d", ones)
+	}
+}
+
+func TestParseJson(t *testing.T) {
+	data := `{"type": "tcp", "tcpForwardingAddr": "127.0.0.1:22", "sshOverSsl": true}`
+	tunnels, err := parse([]byte(data), lookupFrom(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 || tunnels[0].Config.Type != pinggy.TCP || !tunnels[0].Config.SshOverSsl {
+		t.Errorf("unexpected tunnels: %+v", tunnels)
+	}
+}
+
+func TestParseErrorsPointAtKeys(t *testing.T) {
+	data := `
+tunnels:
+  - type: ftp
+  - type: tcp
+    tcpForwardingAddr: localhost
+    ipWhiteList: ["10.0.0.0/33"]
+`
+	_, err := parse([]byte(data), lookupFrom(map[string]string{"PINGGY_TIMEOUT": "soon"}))
+	cerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	keys := make(map[string]bool)
+	for _, p := range cerr.Problems {
+		keys[p.Key] = true
+	}
+	for _, key := range []string{"tunnels[0].type", "tunnels[1].tcpForwardingAddr", "tunnels[1].ipWhiteList[0]", "PINGGY_TIMEOUT"} {
+		if !keys[key] {
+			t.Errorf("no problem reported for %s: %v", key, err)
+		}
+	}
+}
+
+func TestParseUnknownKey(t *testing.T) {
+	_, err := parse([]byte("tokn: abc\n"), lookupFrom(nil))
+	if err == nil || !strings.Contains(err.Error(), "tokn") {
+		t.Errorf("expected unknown key error, got %v", err)
+	}
+}
+
+func TestEnvHeaderManipulation(t *testing.T) {
+	data := `
+type: http
+headerManipulationAndAuth:
+  hostName: file.example.com
+  basicAuths: ["user:password"]
+  bearerAuths: ["file-bearer"]
+`
+	tests := []struct {
+		env         map[string]string
+		hostName    string
+		basicAuths  []string
+		bearerAuths []string
+	}{
+		{
+			map[string]string{"PINGGY_HOST_HEADER": "env.example.com"},
+			"env.example.com", []string{"user:password"}, []string{"file-bearer"},
+		},
+		{
+			map[string]string{"PINGGY_BEARER_AUTHS": "a, b"},
+			"file.example.com", []string{"user:password"}, []string{"a", "b"},
+		},
+		{
+			map[string]string{"PINGGY_BASIC_AUTHS": "env:secret"},
+			"file.example.com", []string{"env:secret"}, []string{"file-bearer"},
+		},
+	}
+	for i, test := range tests {
+		tunnels, err := parse([]byte(data), lookupFrom(test.env))
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		hman := tunnels[0].Config.HeaderManipulationAndAuth
+		if hman.HostName != test.hostName {
+			t.Errorf("%d: host name %q, expected %q", i, hman.HostName, test.hostName)
+		}
+		if len(hman.BasicAuths) != len(test.basicAuths) || len(hman.BearerAuths) != len(test.bearerAuths) {
+			t.Errorf("%d: unexpected auths %v %v", i, hman.BasicAuths, hman.BearerAuths)
+		}
+		for _, auth := range test.basicAuths {
+			if !hman.BasicAuths[base64.StdEncoding.EncodeToString([]byte(auth))] {
+				t.Errorf("%d: basic auth %q missing from %v", i, auth, hman.BasicAuths)
+			}
+		}
+		for _, auth := range test.bearerAuths {
+			if !hman.BearerAuths[auth] {
+				t.Errorf("%d: bearer auth %q missing from %v", i, auth, hman.BearerAuths)
+			}
+		}
+	}
+}
+
+func TestEnvHeaderManipulationErrors(t *testing.T) {
+	data := `
+type: http
+headerManipulationAndAuth:
+  headers:
+    - name: Host
+      values: ["example.com"]
+  basicAuths: ["user:password"]
+`
+	env := map[string]string{"PINGGY_BASIC_AUTHS": "nocolon", "PINGGY_HOST_HEADER": "env.example.com"}
+	_, err := parse([]byte(data), lookupFrom(env))
+	cerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	keys := make(map[string]bool)
+	for _, p := range cerr.Problems {
+		keys[p.Key] = true
+	}
+	// The invalid header comes from the file, the invalid credentials from
+	// the environment.
+	if !keys["PINGGY_BASIC_AUTHS"] {
+		t.Errorf("no problem reported for PINGGY_BASIC_AUTHS: %v", err)
+	}
+	fileKey := false
+	for key := range keys {
+		if strings.HasPrefix(key, "headerManipulationAndAuth.headers") {
+			fileKey = true
+		}
+		if strings.HasPrefix(key, "headerManipulationAndAuth.basicAuths") {
+			t.Errorf("credentials of the environment reported under %s", key)
+		}
+	}
+	if !fileKey {
+		t.Errorf("no problem reported for the headers of the file: %v", err)
+	}
+}
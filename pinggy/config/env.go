@@ -0,0 +1,137 @@
+package config
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "PINGGY_"
+
+/*
+Environment variables understood by the loader, keyed by the name of the
+corresponding file key. Lists are comma separated, durations look like `10s`.
+*/
+var envNames = map[string]string{
+	"token":             "PINGGY_TOKEN",
+	"type":              "PINGGY_TYPE",
+	"altType":           "PINGGY_ALT_TYPE",
+	"server":            "PINGGY_SERVER",
+	"tcpForwardingAddr": "PINGGY_TCP_FORWARDING_ADDR",
+	"udpForwardingAddr": "PINGGY_UDP_FORWARDING_ADDR",
+	"ipWhiteList":       "PINGGY_IP_WHITELIST",
+	"timeout":           "PINGGY_TIMEOUT",
+	"sshOverSsl":        "PINGGY_SSH_OVER_SSL",
+	"proxy":             "PINGGY_PROXY",
+	"keepAliveInterval": "PINGGY_KEEPALIVE_INTERVAL",
+	"privateKeyFile":    "PINGGY_PRIVATE_KEY_FILE",
+	"knownHostsFile":    "PINGGY_KNOWN_HOSTS_FILE",
+	"trustOnFirstUse":   "PINGGY_TRUST_ON_FIRST_USE",
+
+	// Parts of headerManipulationAndAuth
+	"hostName":    "PINGGY_HOST_HEADER",
+	"basicAuths":  "PINGGY_BASIC_AUTHS",
+	"bearerAuths": "PINGGY_BEARER_AUTHS",
+}
+
+func envKey(name string) string {
+	return envNames[name]
+}
+
+func (b *builder) applyEnv(lookupEnv func(string) (string, bool)) {
+	get := func(name string) *string {
+		val, ok := lookupEnv(envNames[name])
+		if !ok {
+			return nil
+		}
+		return &val
+	}
+	getBool := func(name string) *bool {
+		val := get(name)
+		if val == nil {
+			return nil
+		}
+		parsed, err := strconv.ParseBool(strings.TrimSpace(*val))
+		if err != nil {
+			b.err.add(envNames[name], "invalid boolean %q", *val)
+			return nil
+		}
+		return &parsed
+	}
+	getList := func(name string) *[]string {
+		val := get(name)
+		if val == nil {
+			return nil
+		}
+		list := []string{}
+		for _, item := range strings.Split(*val, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return &list
+	}
+
+	b.apply(&fileTunnel{
+		Token:             get("token"),
+		Type:              get("type"),
+		AltType:           get("altType"),
+		Server:            get("server"),
+		TcpForwardingAddr: get("tcpForwardingAddr"),
+		UdpForwardingAddr: get("udpForwardingAddr"),
+		IpWhiteList:       getList("ipWhiteList"),
+		Timeout:           get("timeout"),
+		SshOverSsl:        getBool("sshOverSsl"),
+		Proxy:             get("proxy"),
+		KeepAliveInterval: get("keepAliveInterval"),
+		PrivateKeyFile:    get("privateKeyFile"),
+		KnownHostsFile:    get("knownHostsFile"),
+		TrustOnFirstUse:   getBool("trustOnFirstUse"),
+	}, envKey)
+
+	hostName := get("hostName")
+	basicAuths := getList("basicAuths")
+	bearerAuths := getList("bearerAuths")
+	if hostName == nil && basicAuths == nil && bearerAuths == nil {
+		return
+	}
+
+	// Errors about the parts set here point at their variable, not at the
+	// file.
+	for part, set := range map[string]bool{"HostName": hostName != nil, "BasicAuths": basicAuths != nil, "BearerAuths": bearerAuths != nil} {
+		if set {
+			b.sources["HeaderManipulationAndAuth."+part] = envNames[lowerFirst(part)]
+		}
+	}
+
+	// Keep the header rules from the file, only replace what is set.
+	hman := &fileHeaderManipulation{}
+	key := envNames["basicAuths"]
+	if old := b.conf.HeaderManipulationAndAuth; old != nil {
+		hman.HostName = old.HostName
+		for _, header := range old.Headers {
+			hman.Headers = append(hman.Headers, fileHeader{Name: header.Key, Remove: header.Remove, Values: header.NewValues})
+		}
+		for auth := range old.BasicAuths {
+			// Stored base64 encoded, setHeaderManipulation encodes them again.
+			decoded, err := base64.StdEncoding.DecodeString(auth)
+			if err == nil {
+				hman.BasicAuths = append(hman.BasicAuths, string(decoded))
+			}
+		}
+		for auth := range old.BearerAuths {
+			hman.BearerAuths = append(hman.BearerAuths, auth)
+		}
+		key = b.sources["HeaderManipulationAndAuth"]
+	}
+	if hostName != nil {
+		hman.HostName = *hostName
+	}
+	if basicAuths != nil {
+		hman.BasicAuths = *basicAuths
+	}
+	if bearerAuths != nil {
+		hman.BearerAuths = *bearerAuths
+	}
+	b.setHeaderManipulation(key, hman)
+}
@@ -0,0 +1,136 @@
+package pinggy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+A single problem found while verifying a Config.
+*/
+type ConfigProblem struct {
+	/*
+		Name of the offending Config field, e.g. `Server` or `IpWhiteList[1]`.
+	*/
+	Field string
+
+	/*
+		Human readable description of the problem.
+	*/
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+/*
+ConfigError is returned by ConnectWithConfig and friends when the Config is
+invalid. It lists every problem found, not only the first one.
+*/
+type ConfigError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.String())
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+func (e *ConfigError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, ConfigProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ConfigError) errOrNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+func parseServerAddr(server string) (host string, port int, err error) {
+	if !strings.Contains(server, ":") || strings.HasSuffix(server, "]") || net.ParseIP(server) != nil {
+		return strings.Trim(server, "[]"), 443, nil
+	}
+	host, portStr, err := net.SplitHostPort(server)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("missing host")
+	}
+	return host, port, nil
+}
+
+func verifyForwardingAddr(cerr *ConfigError, field, addr string) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		cerr.add(field, "%v", err)
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		cerr.add(field, "invalid port %q", portStr)
+	}
+}
+
+/*
+verifyHeaderManipulation checks header manipulation and auth rules. Problems
+are reported under the given field prefix.
+*/
+func verifyHeaderManipulation(cerr *ConfigError, field string, hman *HttpHeaderManipulationAndAuthConfig) {
+	for name, header := range hman.Headers {
+		headerField := fmt.Sprintf("%s.Headers[%s]", field, name)
+		if header == nil {
+			cerr.add(headerField, "header rule is nil")
+			continue
+		}
+		if header.Key == "" {
+			cerr.add(headerField, "header name is empty")
+		} else if strings.ContainsAny(header.Key, " \t\r\n:") {
+			cerr.add(headerField, "invalid header name %q", header.Key)
+		}
+		if strings.ToLower(header.Key) == "host" {
+			cerr.add(headerField, "host header is not allowed here, use HostName instead")
+		}
+	}
+	for auth := range hman.BasicAuths {
+		decoded, err := base64.StdEncoding.DecodeString(auth)
+		if err != nil || !strings.Contains(string(decoded), ":") {
+			cerr.add(field+".BasicAuths", "%q is not a base64 encoded `user:password`", auth)
+		}
+	}
+	for key := range hman.BearerAuths {
+		if strings.TrimSpace(key) == "" {
+			cerr.add(field+".BearerAuths", "bearer key is empty")
+		}
+	}
+}
+
+func isFingerprint(fingerprint string) bool {
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		_, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fingerprint, "SHA256:"))
+		return err == nil
+	}
+	// legacy md5 format aa:bb:..., with the prefix of `ssh-keygen -l -E md5` or not
+	parts := strings.Split(strings.TrimPrefix(fingerprint, "MD5:"), ":")
+	if len(parts) != 16 {
+		return false
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 16, 8); err != nil || len(part) != 2 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package pinggy_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := []pinggy.Config{
+		{},
+		{Server: "a.pinggy.io:443", Type: pinggy.TCP, TcpForwardingAddr: "127.0.0.1:4000"},
+		{Server: "[::1]:7878", AltType: pinggy.UDP, UdpForwardingAddr: "localhost:53"},
+		{Server: "::1"},
+		{Type: pinggy.TLS, TlsTermination: &pinggy.TlsTerminationConfig{}},
+	}
+	for i, conf := range valid {
+		if err := conf.Validate(); err != nil {
+			t.Errorf("config %d: unexpected error: %v", i, err)
+		}
+	}
+
+	conf := pinggy.Config{
+		Server:            "a.pinggy.io:abc",
+		Type:              "ftp",
+		AltType:           "sctp",
+		TcpForwardingAddr: "localhost",
+		UdpForwardingAddr: "localhost:53",
+		IpWhiteList:       []*net.IPNet{nil},
+		HeaderManipulationAndAuth: &pinggy.HttpHeaderManipulationAndAuthConfig{
+			Headers: map[string]*pinggy.PinggyHttpHeaderInfo{
+				"host": {Key: "Host", NewValues: []string{"example.com"}},
+			},
+			BasicAuths: map[string]bool{"not base64": true},
+		},
+		TlsTermination:   &pinggy.TlsTerminationConfig{CertFile: "cert.pem"},
+		TcpProxyProtocol: 3,
+	}
+	err := conf.Validate()
+	var cerr *pinggy.ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected *ConfigError, got %v", err)
+	}
+
+	fields := make(map[string]bool)
+	for _, p := range cerr.Problems {
+		fields[p.Field] = true
+	}
+	for _, field := range []string{
+		"Server",
+		"Type",
+		"AltType",
+		"TcpForwardingAddr",
+		"UdpForwardingAddr",
+		"IpWhiteList[0]",
+		"HeaderManipulationAndAuth.Headers[host]",
+		"HeaderManipulationAndAuth.BasicAuths",
+		"TlsTermination",
+		"TcpProxyProtocol",
+	} {
+		if !fields[field] {
+			t.Errorf("no problem reported for %s: %v", field, err)
+		}
+	}
+}
+
+func TestConnectRejectsInvalidConfig(t *testing.T) {
+	_, err := pinggy.ConnectWithConfig(pinggy.Config{Server: "a.pinggy.io:99999"})
+	var cerr *pinggy.ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected *ConfigError, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package pinggy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+/*
+silentServer accepts tcp connections and never answers. Every accepted
+connection is sent on the returned channel once the client closes it.
+*/
+func silentServer(t *testing.T) (string, <-chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	closed := make(chan struct{}, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return listener.Addr().String(), closed
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	for _, sshOverSsl := range []bool{false, true} {
+		addr, closed := silentServer(t)
+		goroutines := runtime.NumGoroutine()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+		result := make(chan error, 1)
+		go func() {
+			_, err := ConnectContext(ctx, Config{Server: addr, SshOverSsl: sshOverSsl})
+			result <- err
+		}()
+
+		select {
+		case err := <-result:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("ssh over ssl %v: expected context.Canceled, got %v", sshOverSsl, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ssh over ssl %v: handshake not aborted", sshOverSsl)
+		}
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ssh over ssl %v: connection not closed", sshOverSsl)
+		}
+
+		// Nothing is left running, closeOnCancel included. The server side
+		// goroutine has ended as well.
+		waitFor(t, "goroutines to end", func() bool {
+			return runtime.NumGoroutine() <= goroutines
+		})
+	}
+}
+
+func TestConnectContextCancelled(t *testing.T) {
+	addr, _ := silentServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ConnectContext(ctx, Config{Server: addr}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func TestCloseOnCancel(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	closed := make(chan struct{}, 2)
+	closer := closerFunc(func() error {
+		closed <- struct{}{}
+		return nil
+	})
+
+	// Stopped before ctx is done, nothing is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := closeOnCancel(ctx, closer)
+	if stop() || stop() {
+		t.Fatal("reported as cancelled")
+	}
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	stop = closeOnCancel(ctx, closer)
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed on cancel")
+	}
+	if !stop() {
+		t.Fatal("not reported as cancelled")
+	}
+	select {
+	case <-closed:
+		t.Fatal("closed twice")
+	default:
+	}
+
+	waitFor(t, "goroutines to end", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+}
@@ -0,0 +1,155 @@
+/*
+Package control talks to the tunnel API the pinggy server exposes at
+`localhost:4300`. The address is only reachable through the ssh connection of
+a tunnel, so the client is built on top of a function dialing through it:
+
+	client := control.NewClient(func() (net.Conn, error) {
+		return sshClient.Dial("tcp", control.Addr)
+	})
+	urls, err := client.Urls(ctx)
+
+A PinggyListener provides a ready to use client through its Control method.
+*/
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+Address of the tunnel API, as seen from the ssh connection.
+*/
+const Addr = "localhost:4300"
+
+const baseUrl = "http://" + Addr
+
+/*
+DialFunc opens a new connection to the tunnel API.
+*/
+type DialFunc func() (net.Conn, error)
+
+/*
+StatusError is returned when the server answers with a non 2xx status.
+*/
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+
+	/*
+		Body of the response, trimmed.
+	*/
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s %s: server responded with %s", e.Method, e.Path, e.Status)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+/*
+Client for the tunnel API. It is safe for concurrent use.
+*/
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(dial DialFunc) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial()
+		},
+		// Every request gets its own channel. Idle channels would otherwise
+		// outlive the ssh connection they belong to.
+		DisableKeepAlives: true,
+	}
+	return &Client{httpClient: &http.Client{Transport: transport}}
+}
+
+/*
+HttpClient returns the underlying http client. Requests have to be sent to
+`http://localhost:4300`.
+*/
+func (c *Client) HttpClient() *http.Client {
+	return c.httpClient
+}
+
+/*
+Do sends a request to the given path of the tunnel API. A non nil body is
+encoded as json. If out is not nil, the response is decoded into it. Non 2xx
+responses are reported as *StatusError.
+*/
+func (c *Client) Do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		jsonBytes, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %v", err)
+		}
+		reqBody = bytes.NewReader(jsonBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, baseUrl+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &StatusError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       strings.TrimSpace(string(respBody)),
+		}
+	}
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+/*
+Urls returns the public urls of the tunnel.
+*/
+func (c *Client) Urls(ctx context.Context) ([]string, error) {
+	var resp UrlsResponse
+	if err := c.Do(ctx, http.MethodGet, "/urls", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Urls, nil
+}
+
+/*
+SetHeaderManipulation replaces the header manipulation and auth rules of an
+http tunnel.
+*/
+func (c *Client) SetHeaderManipulation(ctx context.Context, conf *HttpHeaderManipulationAndAuthConfig) error {
+	return c.Do(ctx, http.MethodPut, "/headerman", conf, nil)
+}
@@ -0,0 +1,74 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return NewClient(func() (net.Conn, error) {
+		return net.Dial("tcp", srv.Listener.Addr().String())
+	})
+}
+
+func TestUrls(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/urls" || r.Host != Addr {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"urls":["http://abc.a.pinggy.link","https://abc.a.pinggy.link"]}`))
+	})
+
+	urls, err := client.Urls(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[1] != "https://abc.a.pinggy.link" {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+}
+
+func TestSetHeaderManipulation(t *testing.T) {
+	var got HttpHeaderManipulationAndAuthConfig
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/headerman" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(got.BearerAuths) == 0 {
+			http.Error(w, "no bearer key", http.StatusUnprocessableEntity)
+		}
+	})
+
+	err := client.SetHeaderManipulation(context.Background(), &HttpHeaderManipulationAndAuthConfig{
+		HostName:    "example.com",
+		BearerAuths: map[string]bool{"secret": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HostName != "example.com" || !got.BearerAuths["secret"] {
+		t.Fatalf("unexpected request body %+v", got)
+	}
+
+	err = client.SetHeaderManipulation(context.Background(), &HttpHeaderManipulationAndAuthConfig{})
+	var serr *StatusError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a StatusError, got %v", err)
+	}
+	if serr.StatusCode != http.StatusUnprocessableEntity || serr.Body != "no bearer key" {
+		t.Fatalf("unexpected error %v", serr)
+	}
+}
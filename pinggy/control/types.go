@@ -0,0 +1,49 @@
+package control
+
+type HttpHeaderInfo struct {
+	/*
+		Header name. Case insensitive
+		Key can be any header name. However, host is not allowed here.
+	*/
+	Key string `json:"headerName"`
+
+	/*
+		Whether or not to remove existing headers
+	*/
+	Remove bool `json:"remove"`
+
+	/*
+		New Values for the header. If Remove is false, new headers
+		would be added again.
+	*/
+	NewValues []string `json:"values"`
+}
+
+type HttpHeaderManipulationAndAuthConfig struct {
+	/*
+		New value for the `Host` Header. It is special header.
+	*/
+	HostName string `json:"hostName"`
+
+	/*
+		Request Header modification info.
+	*/
+	Headers map[string]*HttpHeaderInfo `json:"headers"`
+
+	/*
+		List of base64 encoded basic auth info.
+	*/
+	BasicAuths map[string]bool `json:"basicAuths"`
+
+	/*
+		List of keys for bearer authentication
+	*/
+	BearerAuths map[string]bool `json:"bearerAuths"`
+}
+
+/*
+Response of the `/urls` endpoint.
+*/
+type UrlsResponse struct {
+	Urls []string `json:"urls"`
+}
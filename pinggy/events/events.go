@@ -0,0 +1,313 @@
+/*
+Package events defines the events emitted by a pinggy tunnel and the bus
+delivering them to subscribers.
+*/
+package events
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/servermsg"
+)
+
+type Type int
+
+const (
+	/*
+		The ssh connection to the server is established, initially or after a
+		reconnection. Server is set.
+	*/
+	Connected Type = iota
+
+	/*
+		The ssh connection is gone. Err tells why, if known.
+	*/
+	Disconnected
+
+	/*
+		The server assigned new public urls to the tunnel. Urls is set.
+	*/
+	UrlsAssigned
+
+	/*
+		A visitor connected through the tunnel. RemoteAddr is set.
+	*/
+	VisitorOpened
+
+	/*
+		A visitor connection got closed. BytesIn, BytesOut and Duration are set.
+	*/
+	VisitorClosed
+
+	/*
+		A new udp session started. RemoteAddr is set.
+	*/
+	UdpSessionCreated
+
+	/*
+		A udp session ended. BytesIn, BytesOut and Duration are set.
+	*/
+	UdpSessionExpired
+
+	/*
+		Connecting to the forwarding address failed. Addr and Err are set.
+	*/
+	DialFailed
+
+	/*
+		A line printed by the server on the session. Message, Stream and Parsed
+		are set.
+	*/
+	ServerMessage
+
+	/*
+		A visitor connection was refused by the forwarding limits. RemoteAddr
+		and Err are set.
+	*/
+	VisitorRejected
+)
+
+func (t Type) String() string {
+	switch t {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case UrlsAssigned:
+		return "urls_assigned"
+	case VisitorOpened:
+		return "visitor_opened"
+	case VisitorClosed:
+		return "visitor_closed"
+	case UdpSessionCreated:
+		return "udp_session_created"
+	case UdpSessionExpired:
+		return "udp_session_expired"
+	case DialFailed:
+		return "dial_failed"
+	case ServerMessage:
+		return "server_message"
+	case VisitorRejected:
+		return "visitor_rejected"
+	default:
+		return fmt.Sprintf("event(%d)", int(t))
+	}
+}
+
+type Event struct {
+	Type Type
+	Time time.Time
+
+	/*
+		Address of the server the ssh connection goes to.
+	*/
+	Server string
+
+	/*
+		Public urls of the tunnel.
+	*/
+	Urls []string
+
+	/*
+		Address of the visitor, as reported by the server.
+	*/
+	RemoteAddr net.Addr
+
+	/*
+		Bytes received from and sent to the visitor.
+	*/
+	BytesIn  int64
+	BytesOut int64
+
+	/*
+		Lifetime of the connection or udp session.
+	*/
+	Duration time.Duration
+
+	/*
+		Forwarding address that could not be reached.
+	*/
+	Addr string
+
+	Err error
+
+	/*
+		Server message, without the line ending.
+	*/
+	Message string
+
+	/*
+		`stdout` or `stderr`.
+	*/
+	Stream string
+
+	/*
+		The server message, classified.
+	*/
+	Parsed *servermsg.Message
+}
+
+type Handler func(Event)
+
+/*
+Bus delivers published events to every subscriber. Each subscriber receives
+the events in order from its own goroutine, so a slow handler neither blocks
+the tunnel nor the other subscribers. A nil *Bus discards everything.
+*/
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+type subscriber struct {
+	handler  Handler
+	mu       sync.Mutex
+	queue    []Event
+	finished bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*subscriber]struct{})}
+}
+
+/*
+Subscribe calls handler for every event published from now on, until the
+returned function is called.
+*/
+func (b *Bus) Subscribe(handler Handler) (unsubscribe func()) {
+	sub := &subscriber{
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return func() {}
+	}
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	go sub.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+			close(sub.done)
+		})
+	}
+}
+
+/*
+Close stops the bus. Events already published are still delivered, later
+ones are discarded.
+*/
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subscribers {
+		sub.finish()
+	}
+	b.subscribers = make(map[*subscriber]struct{})
+}
+
+/*
+HasSubscribers reports whether anyone listens, to skip work otherwise.
+*/
+func (b *Bus) HasSubscribers() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0
+}
+
+/*
+Publish queues event for every subscriber. It never blocks on handlers and it
+can be called with locks held. Time is set if it is empty.
+*/
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		sub.push(event)
+	}
+}
+
+func (s *subscriber) push(event Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, event)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) finish() {
+	s.mu.Lock()
+	s.finished = true
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next queued event. Once the queue is empty, finished tells
+// whether the subscriber should stop.
+func (s *subscriber) pop() (event Event, ok bool, finished bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		return Event{}, false, s.finished
+	}
+	event = s.queue[0]
+	s.queue[0] = Event{}
+	s.queue = s.queue[1:]
+	return event, true, false
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		for {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			event, ok, finished := s.pop()
+			if finished {
+				return
+			}
+			if !ok {
+				break
+			}
+			s.handler(event)
+		}
+	}
+}
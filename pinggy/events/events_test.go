@@ -0,0 +1,79 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusDeliversInOrder(t *testing.T) {
+	bus := NewBus()
+	received := make(chan Event, 10)
+	unsubscribe := bus.Subscribe(func(event Event) {
+		received <- event
+	})
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(Event{Type: ServerMessage, Message: string(rune('a' + i))})
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-received:
+			if want := string(rune('a' + i)); event.Message != want {
+				t.Fatalf("got message %q, want %q", event.Message, want)
+			}
+			if event.Time.IsZero() {
+				t.Fatal("event time is not set")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+
+	unsubscribe()
+	bus.Publish(Event{Type: ServerMessage})
+	select {
+	case event := <-received:
+		t.Fatalf("received %v after unsubscribing", event.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBusCloseDeliversPending(t *testing.T) {
+	bus := NewBus()
+	block := make(chan struct{})
+	received := make(chan Event, 10)
+	bus.Subscribe(func(event Event) {
+		<-block
+		received <- event
+	})
+
+	bus.Publish(Event{Type: Connected})
+	bus.Publish(Event{Type: Disconnected})
+	bus.Close()
+	bus.Publish(Event{Type: Connected})
+	close(block)
+
+	for _, want := range []Type{Connected, Disconnected} {
+		select {
+		case event := <-received:
+			if event.Type != want {
+				t.Fatalf("got %v, want %v", event.Type, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v not delivered", want)
+		}
+	}
+	select {
+	case event := <-received:
+		t.Fatalf("received %v after closing", event.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	bus.Publish(Event{Type: Connected})
+	if bus.HasSubscribers() {
+		t.Fatal("nil bus has subscribers")
+	}
+}
@@ -28,11 +28,11 @@ func setupCopyFile(conn net.Conn) {
 func main() {
 	log.SetFlags(log.Llongfile | log.LstdFlags)
 	// pinggy.ServeFileWithConfig(pinggy.FileServerConfi?g{Path: "/tmp/", Conf: pinggy.Config{Type: pinggy.HTTP}, WebDebugEnabled: true})
-	pl, err := pinggy.ConnectWithConfig(pinggy.Config{})
+	pl, err := pinggy.ConnectWithConfig(pinggy.Config{Logger: log.Default()})
 	if err != nil {
 		log.Fatal(err)
 	}
-	pl.InitiateWebDebug("0.0.0.0:4300")
+	pl.InitiateWebDebug("localhost:4300")
 	fmt.Println(pl.RemoteUrls())
 	// pl.ServeHttp(os.DirFS("/tmp"))
 	for {
@@ -31,7 +31,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	pl.InitiateWebDebug("0.0.0.0:4300")
+	pl.InitiateWebDebug("localhost:4300")
 	fmt.Println(pl.RemoteUrls())
 	// pl.ServeHttp(os.DirFS("/tmp"))
 	buffer := make([]byte, 2096)
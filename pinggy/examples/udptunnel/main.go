@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"strconv"
 
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
 	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
 )
 
@@ -25,5 +27,8 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	logger := logging.NewStdLogger(log.Default(), logging.LevelInfo)
+	forwarder.SetLogger(logger)
+	logger.Info("listening", "port", tcpPort)
 	forwarder.StartForwarding()
 }
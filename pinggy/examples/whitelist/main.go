@@ -21,6 +21,7 @@ func main() {
 		IpWhiteList:       []*net.IPNet{ipnet},
 		Stdout:            os.Stderr,
 		Stderr:            os.Stderr,
+		Logger:            log.Default(),
 	}
 
 	pl, err := pinggy.ConnectWithConfig(config)
@@ -82,13 +82,13 @@ func ServeFileWithConfig(conf FileServerConfig) {
 		if port <= 0 {
 			port = 4300
 		}
-		err := l.InitiateWebDebug(fmt.Sprintf("0.0.0.0:%d", port))
+		err := l.InitiateWebDebug(fmt.Sprintf("localhost:%d", port))
 		if err != nil {
 			log.Println(err)
 			l.Close()
 			os.Exit(1)
 		}
-		fmt.Printf("WebDebugUI running at http://0.0.0.0:%d/\n", port)
+		fmt.Printf("WebDebugUI running at http://localhost:%d/\n", port)
 	}
 	// log.Fatal(http.Serve(l, nil))
 	log.Fatal(l.ServeHttp(fs))
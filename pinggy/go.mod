@@ -2,7 +2,10 @@ module github.com/Pinggy-io/pinggy-go/pinggy
 
 go 1.16
 
-require golang.org/x/crypto v0.8.0
+require (
+	golang.org/x/crypto v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 retract v0.0.0-20240101024325-6bb8db62dbef
-retract v0.0.0-20240101031039-f691161a70b6
\ No newline at end of file
+retract v0.0.0-20240101031039-f691161a70b6
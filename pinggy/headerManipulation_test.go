@@ -0,0 +1,123 @@
+package pinggy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testHeaderConfig(value string) *HttpHeaderManipulationAndAuthConfig {
+	return &HttpHeaderManipulationAndAuthConfig{
+		Headers: map[string]*PinggyHttpHeaderInfo{
+			"x-test": {Key: "X-Test", NewValues: []string{value}},
+		},
+		BearerAuths: map[string]bool{"token": true},
+	}
+}
+
+func TestUpdateHeaderManipulationValidation(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+
+	invalid := []*HttpHeaderManipulationAndAuthConfig{
+		{Headers: map[string]*PinggyHttpHeaderInfo{"host": {Key: "Host", NewValues: []string{"example.com"}}}},
+		{Headers: map[string]*PinggyHttpHeaderInfo{"x-test": nil}},
+		{Headers: map[string]*PinggyHttpHeaderInfo{"x-test": {Key: "X Test"}}},
+		{BasicAuths: map[string]bool{"not base64": true}},
+		{BearerAuths: map[string]bool{" ": true}},
+	}
+	for i, hman := range invalid {
+		if err := pl.UpdateHeaderManipulationAndAuth(hman); err == nil {
+			t.Errorf("config %d: expected an error", i)
+		}
+	}
+	// Nothing reached the server, not even a session.
+	if headers := s.headerRequests(); len(headers) != 0 {
+		t.Fatalf("unexpected header requests %q", headers)
+	}
+	expectCommands(t, s)
+
+	tcp := s.connect(t, Config{Type: TCP})
+	if err := tcp.UpdateHeaderManipulationAndAuth(testHeaderConfig("1")); err == nil {
+		t.Fatal("expected an error for a tcp tunnel")
+	}
+}
+
+func TestUpdateHeaderManipulation(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+	expectCommands(t, s)
+
+	// The server applies the config once a session is open.
+	if err := pl.UpdateHeaderManipulationAndAuth(testHeaderConfig("1")); err != nil {
+		t.Fatal(err)
+	}
+	expectCommands(t, s, "shell")
+	// The session is kept for the next updates.
+	if err := pl.UpdateHeaderManipulationAndAuth(testHeaderConfig("2")); err != nil {
+		t.Fatal(err)
+	}
+	expectCommands(t, s, "shell")
+
+	headers := s.headerRequests()
+	if len(headers) != 2 || !strings.Contains(headers[0], `"values":["1"]`) || !strings.Contains(headers[1], `"values":["2"]`) {
+		t.Fatalf("unexpected header requests %q", headers)
+	}
+
+	// A rejected config is not kept.
+	s.setHeaderStatus(http.StatusBadRequest)
+	if err := pl.UpdateHeaderManipulationAndAuth(testHeaderConfig("3")); err == nil {
+		t.Fatal("expected an error for a rejected config")
+	}
+	pl.mu.Lock()
+	kept := pl.conf.HeaderManipulationAndAuth.Headers["x-test"].NewValues[0]
+	pl.mu.Unlock()
+	if kept != "2" {
+		t.Fatalf("rejected config kept, got value %s", kept)
+	}
+}
+
+func TestUpdateHeaderManipulationWithWhiteList(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{IpWhiteList: []*net.IPNet{mustParseCidr(t, "10.0.0.0/8")}})
+
+	// The session of the whitelist is used, no shell is opened.
+	if err := pl.UpdateHeaderManipulationAndAuth(testHeaderConfig("1")); err != nil {
+		t.Fatal(err)
+	}
+	expectCommands(t, s, " w:10.0.0.0/8")
+}
+
+func TestUpdateHeaderManipulationReconnect(t *testing.T) {
+	s := newTestServer(t)
+	reconnected := make(chan []string, 1)
+	pl := s.connect(t, Config{Reconnect: &ReconnectConfig{
+		InitialBackoff: 10 * time.Millisecond,
+		OnReconnect: func(urls []string) {
+			reconnected <- urls
+		},
+	}})
+	if err := pl.UpdateHeaderManipulationAndAuth(testHeaderConfig("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := acceptAsync(pl)
+	s.dropAll()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+
+	// The session is started again and the config replayed.
+	expectCommands(t, s, "shell", "shell")
+	headers := s.headerRequests()
+	if len(headers) != 2 || headers[1] != headers[0] {
+		t.Fatalf("config not replayed: %q", headers)
+	}
+
+	pl.Close()
+	expectAccepted(t, accepted)
+}
@@ -0,0 +1,179 @@
+package pinggy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+HostKeyMismatchError is returned when the key presented by the server does not
+match any of the pinned fingerprints or the keys recorded in the known hosts file.
+*/
+type HostKeyMismatchError struct {
+	/*
+		Address of the server as used for the verification, i.e. host:port.
+	*/
+	Host string
+
+	/*
+		SHA256 fingerprint of the key presented by the server.
+	*/
+	Fingerprint string
+
+	/*
+		Fingerprints of the keys that would have been accepted: the pinned ones
+		as given, or the SHA256 ones of the known hosts file.
+	*/
+	Expected []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("host key %s for %s is not trusted", e.Fingerprint, e.Host)
+	}
+	return fmt.Sprintf("host key mismatch for %s: server presented %s, expected %s",
+		e.Host, e.Fingerprint, strings.Join(e.Expected, " or "))
+}
+
+// known_hosts files can be shared among multiple tunnels.
+var trustedHostKeysLock sync.Mutex
+
+type hostKeyVerifier struct {
+	conf *Config
+
+	// The ssh package flattens errors returned by the HostKeyCallback
+	// into strings. Keep the original error so that callers can inspect it.
+	err error
+}
+
+func newHostKeyVerifier(conf *Config) *hostKeyVerifier {
+	return &hostKeyVerifier{conf: conf}
+}
+
+func (v *hostKeyVerifier) enabled() bool {
+	return len(v.conf.HostKeyFingerprints) > 0 || v.conf.KnownHostsFile != ""
+}
+
+func (v *hostKeyVerifier) callback() ssh.HostKeyCallback {
+	if !v.enabled() {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		v.err = v.verify(hostname, remote, key)
+		return v.err
+	}
+}
+
+/*
+matchesFingerprint tells if key has the fingerprint pinned, in any format
+printed by `ssh-keygen -l`.
+*/
+func matchesFingerprint(pinned string, key ssh.PublicKey) bool {
+	if pinned == ssh.FingerprintSHA256(key) {
+		return true
+	}
+	return strings.EqualFold(strings.TrimPrefix(pinned, "MD5:"), ssh.FingerprintLegacyMD5(key))
+}
+
+/*
+verify accepts key if it matches a pinned fingerprint. Pinned fingerprints
+are authoritative: the known hosts file is only used without them.
+*/
+func (v *hostKeyVerifier) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if len(v.conf.HostKeyFingerprints) > 0 {
+		for _, pinned := range v.conf.HostKeyFingerprints {
+			if matchesFingerprint(pinned, key) {
+				return nil
+			}
+		}
+		return &HostKeyMismatchError{Host: hostname, Fingerprint: fingerprint, Expected: append([]string{}, v.conf.HostKeyFingerprints...)}
+	}
+
+	expected := []string{}
+	if v.conf.KnownHostsFile != "" {
+		// Held until the key is trusted, so that concurrent first connections
+		// do not both record a key.
+		trustedHostKeysLock.Lock()
+		defer trustedHostKeysLock.Unlock()
+
+		known, err := v.checkKnownHosts(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		for _, k := range keyErr.Want {
+			expected = append(expected, ssh.FingerprintSHA256(k.Key))
+		}
+		if !known && v.conf.TrustOnFirstUse {
+			return v.trust(hostname, key)
+		}
+	}
+
+	return &HostKeyMismatchError{Host: hostname, Fingerprint: fingerprint, Expected: expected}
+}
+
+/*
+checkKnownHosts verifies the key against the known hosts file. known reports
+whether the file contains any key for the host at all. It expects
+trustedHostKeysLock to be held.
+*/
+func (v *hostKeyVerifier) checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) (known bool, err error) {
+	path := v.conf.KnownHostsFile
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && v.conf.TrustOnFirstUse {
+		return false, &knownhosts.KeyError{}
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return false, err
+	}
+	err = callback(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		return len(keyErr.Want) > 0, err
+	}
+	return true, err
+}
+
+// trust expects trustedHostKeysLock to be held.
+func (v *hostKeyVerifier) trust(hostname string, key ssh.PublicKey) error {
+	path := v.conf.KnownHostsFile
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	if err != nil {
+		return err
+	}
+	v.conf.log.Info("trusting host key", "host", hostname, "fingerprint", ssh.FingerprintSHA256(key))
+	return nil
+}
+
+/*
+Default location for the host keys learned with TrustOnFirstUse.
+*/
+func defaultKnownHostsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "pinggy", "known_hosts")
+}
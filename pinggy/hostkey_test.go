@@ -0,0 +1,206 @@
+package pinggy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testHostname = "a.pinggy.io:443"
+
+var testRemote = &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 443}
+
+func generateHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func expectMismatch(t *testing.T, err error, key ssh.PublicKey, expected ...string) {
+	t.Helper()
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a HostKeyMismatchError, got %v", err)
+	}
+	if mismatch.Host != testHostname || mismatch.Fingerprint != ssh.FingerprintSHA256(key) {
+		t.Fatalf("unexpected error %v", mismatch)
+	}
+	if strings.Join(mismatch.Expected, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, mismatch.Expected)
+	}
+}
+
+func TestHostKeyFingerprints(t *testing.T) {
+	key := generateHostKey(t)
+	other := generateHostKey(t)
+
+	md5 := ssh.FingerprintLegacyMD5(key)
+	for _, fingerprint := range []string{ssh.FingerprintSHA256(key), md5, "MD5:" + md5, strings.ToUpper(md5)} {
+		v := newHostKeyVerifier(&Config{HostKeyFingerprints: []string{fingerprint}, log: logging.Nop()})
+		if err := v.verify(testHostname, testRemote, key); err != nil {
+			t.Fatalf("%s: %v", fingerprint, err)
+		}
+	}
+
+	pinned := ssh.FingerprintSHA256(other)
+	v := newHostKeyVerifier(&Config{HostKeyFingerprints: []string{pinned}, log: logging.Nop()})
+	expectMismatch(t, v.verify(testHostname, testRemote, key), key, pinned)
+}
+
+func TestHostKeyPinnedAuthoritative(t *testing.T) {
+	key := generateHostKey(t)
+	other := generateHostKey(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(testHostname)}, key) + "\n"
+	if err := ioutil.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key recorded in the known hosts file is not pinned.
+	pinned := ssh.FingerprintSHA256(other)
+	v := newHostKeyVerifier(&Config{HostKeyFingerprints: []string{pinned}, KnownHostsFile: path, log: logging.Nop()})
+	expectMismatch(t, v.verify(testHostname, testRemote, key), key, pinned)
+	if err := v.verify(testHostname, testRemote, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is trusted on first use besides the pinned keys.
+	path = filepath.Join(t.TempDir(), "known_hosts")
+	v = newHostKeyVerifier(&Config{HostKeyFingerprints: []string{pinned}, KnownHostsFile: path, TrustOnFirstUse: true, log: logging.Nop()})
+	expectMismatch(t, v.verify(testHostname, testRemote, key), key, pinned)
+	if err := v.verify(testHostname, testRemote, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(path); err == nil {
+		t.Fatal("known hosts file written with pinned fingerprints")
+	}
+}
+
+func TestIsFingerprint(t *testing.T) {
+	key := generateHostKey(t)
+	md5 := ssh.FingerprintLegacyMD5(key)
+	tests := map[string]bool{
+		ssh.FingerprintSHA256(key): true,
+		md5:                        true,
+		"MD5:" + md5:               true,
+		strings.ToUpper(md5):       true,
+		"SHA256:not base64!":       false,
+		"MD5:" + md5[3:]:           false,
+		"sha256:abc":               false,
+		"":                         false,
+	}
+	for fingerprint, valid := range tests {
+		if isFingerprint(fingerprint) != valid {
+			t.Errorf("%q: expected valid %v", fingerprint, valid)
+		}
+	}
+}
+
+func TestHostKeyKnownHosts(t *testing.T) {
+	key := generateHostKey(t)
+	other := generateHostKey(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(testHostname)}, key) + "\n"
+	if err := ioutil.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newHostKeyVerifier(&Config{KnownHostsFile: path, log: logging.Nop()})
+	if err := v.verify(testHostname, testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+	expectMismatch(t, v.verify(testHostname, testRemote, other), other, ssh.FingerprintSHA256(key))
+
+	// A recorded key is never replaced, even with TrustOnFirstUse.
+	v = newHostKeyVerifier(&Config{KnownHostsFile: path, TrustOnFirstUse: true, log: logging.Nop()})
+	expectMismatch(t, v.verify(testHostname, testRemote, other), other, ssh.FingerprintSHA256(key))
+
+	// Unknown hosts are rejected without TrustOnFirstUse.
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v = newHostKeyVerifier(&Config{KnownHostsFile: path, log: logging.Nop()})
+	expectMismatch(t, v.verify(testHostname, testRemote, key), key)
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	key := generateHostKey(t)
+	other := generateHostKey(t)
+	path := filepath.Join(t.TempDir(), "pinggy", "known_hosts")
+
+	v := newHostKeyVerifier(&Config{KnownHostsFile: path, TrustOnFirstUse: true, log: logging.Nop()})
+	if err := v.verify(testHostname, testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(testHostname, testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+	expectMismatch(t, v.verify(testHostname, testRemote, other), other, ssh.FingerprintSHA256(key))
+
+	// The recorded key is enforced without TrustOnFirstUse as well.
+	v = newHostKeyVerifier(&Config{KnownHostsFile: path, log: logging.Nop()})
+	if err := v.verify(testHostname, testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+	expectMismatch(t, v.verify(testHostname, testRemote, other), other, ssh.FingerprintSHA256(key))
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 1 {
+		t.Fatalf("expected a single known host, got %d:\n%s", lines, content)
+	}
+}
+
+func TestHostKeyTrustOnFirstUseConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	keys := []ssh.PublicKey{generateHostKey(t), generateHostKey(t)}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := newHostKeyVerifier(&Config{KnownHostsFile: path, TrustOnFirstUse: true, log: logging.Nop()})
+			errs[i] = v.verify(testHostname, testRemote, keys[i%2])
+		}(i)
+	}
+	wg.Wait()
+
+	// Only the first key is trusted, all connections presenting the other
+	// one are rejected.
+	trusted := 0
+	for _, err := range errs {
+		if err == nil {
+			trusted++
+		}
+	}
+	if trusted != len(errs)/2 {
+		t.Fatalf("expected %d trusted connections, got %d: %v", len(errs)/2, trusted, errs)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 1 {
+		t.Fatalf("expected a single known host, got %d:\n%s", lines, content)
+	}
+}
@@ -0,0 +1,242 @@
+package inspector
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type inspectingListener struct {
+	net.Listener
+	inspector *Inspector
+}
+
+func (l *inspectingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.inspector.Conn(conn), nil
+}
+
+/*
+Conn wraps a visitor connection. Requests are read from it and responses are
+written to it, as done by http servers or by tunnel forwarding.
+*/
+func (in *Inspector) Conn(conn net.Conn) net.Conn {
+	reqReader, reqWriter := io.Pipe()
+	respReader, respWriter := io.Pipe()
+	ic := &inspectedConn{
+		Conn:       conn,
+		reqReader:  reqReader,
+		reqWriter:  reqWriter,
+		respReader: respReader,
+		respWriter: respWriter,
+	}
+	pending := make(chan *pendingExchange, maxPendingExchanges)
+	go in.readRequests(conn.RemoteAddr().String(), reqReader, pending)
+	go in.readResponses(respReader, pending)
+	return ic
+}
+
+/*
+inspectedConn copies the traffic into pipes read by the parsers. The parsers
+always drain their pipe, so the traffic only waits for them to parse.
+*/
+type inspectedConn struct {
+	net.Conn
+
+	reqReader  *io.PipeReader
+	reqWriter  *io.PipeWriter
+	respReader *io.PipeReader
+	respWriter *io.PipeWriter
+	closeOnce  sync.Once
+}
+
+func (c *inspectedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.reqWriter.Write(b[:n])
+	}
+	if err != nil && !isTimeout(err) {
+		c.reqWriter.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (c *inspectedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.respWriter.Write(b[:n])
+	}
+	if err != nil && !isTimeout(err) {
+		c.respWriter.CloseWithError(err)
+	}
+	return n, err
+}
+
+func (c *inspectedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.reqWriter.Close()
+		c.respWriter.Close()
+		// Unblocks writes the parsers have not consumed yet.
+		c.reqReader.Close()
+		c.respReader.Close()
+	})
+	return c.Conn.Close()
+}
+
+// Deadlines are used to interrupt reads, e.g. by http servers, the connection
+// is still usable afterwards.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+/*
+Requests of a connection which may wait for their response. Pipelining more
+of them stops the inspection of the connection, see Inspector.Dropped.
+*/
+const maxPendingExchanges = 64
+
+type pendingExchange struct {
+	exchange *Exchange
+	request  *http.Request
+}
+
+/*
+bodyRecorder keeps the first max bytes written to it and counts the rest.
+*/
+type bodyRecorder struct {
+	max  int
+	body []byte
+	size int64
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.size += int64(len(b))
+	if room := r.max - len(r.body); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		r.body = append(r.body, b[:room]...)
+	}
+	return len(b), nil
+}
+
+func (r *bodyRecorder) truncated() bool {
+	return r.size > int64(len(r.body))
+}
+
+func (in *Inspector) readRequests(remoteAddr string, r io.Reader, pending chan<- *pendingExchange) {
+	defer close(pending)
+	defer io.Copy(io.Discard, r)
+	br := bufio.NewReader(r)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		// Only this goroutine sends, so the send below cannot block. Skipping
+		// a request would pair the responses with the wrong requests, the
+		// rest of the connection is not recorded instead.
+		if len(pending) == cap(pending) {
+			in.drop()
+			return
+		}
+		exchange := &Exchange{
+			RemoteAddr: remoteAddr,
+			Start:      time.Now(),
+			Request: Request{
+				Method: req.Method,
+				URL:    req.RequestURI,
+				Proto:  req.Proto,
+				Host:   req.Host,
+				Header: req.Header,
+			},
+		}
+		in.add(exchange)
+		// Handed over before reading the body, the response may come first.
+		pending <- &pendingExchange{exchange: exchange, request: req}
+
+		recorder := &bodyRecorder{max: in.conf.MaxBodySize}
+		_, err = io.Copy(recorder, req.Body)
+		in.update(exchange, func(e *Exchange) {
+			e.Request.Body = recorder.body
+			e.Request.BodySize = recorder.size
+			e.Request.BodyTruncated = recorder.truncated()
+			e.RequestEnd = time.Now()
+			if err != nil {
+				e.Error = "incomplete request body: " + err.Error()
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (in *Inspector) readResponses(r io.Reader, pending <-chan *pendingExchange) {
+	defer func() {
+		// Keep both sides flowing once parsing stopped.
+		go func() {
+			for range pending {
+			}
+		}()
+		io.Copy(io.Discard, r)
+	}()
+	br := bufio.NewReader(r)
+	for p := range pending {
+		resp, err := readFinalResponse(br, p.request)
+		if err != nil {
+			in.update(p.exchange, func(e *Exchange) {
+				e.Error = "no response: " + err.Error()
+			})
+			return
+		}
+		in.update(p.exchange, func(e *Exchange) {
+			e.ResponseStart = time.Now()
+			e.Response = &Response{
+				Proto:      resp.Proto,
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+				Header:     resp.Header,
+			}
+		})
+
+		recorder := &bodyRecorder{max: in.conf.MaxBodySize}
+		_, err = io.Copy(recorder, resp.Body)
+		in.update(p.exchange, func(e *Exchange) {
+			// Replace the response, copies may share the previous one.
+			response := *e.Response
+			response.Body = recorder.body
+			response.BodySize = recorder.size
+			response.BodyTruncated = recorder.truncated()
+			e.Response = &response
+			e.End = time.Now()
+			if err != nil {
+				e.Error = "incomplete response body: " + err.Error()
+			}
+		})
+		if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			// Whatever follows is not http anymore.
+			return
+		}
+	}
+}
+
+// readFinalResponse skips informational responses like `100 Continue`.
+func readFinalResponse(br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package inspector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+HAR 1.2 document, see http://www.softwareishard.com/blog/har-12-spec/.
+Visitor addresses and body truncation are kept in custom `_` fields.
+*/
+type Har struct {
+	Log HarLog `json:"log"`
+}
+
+type HarLog struct {
+	Version string     `json:"version"`
+	Creator HarCreator `json:"creator"`
+	Entries []HarEntry `json:"entries"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+type HarCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HarEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HarRequest  `json:"request"`
+	Response        HarResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HarTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+
+	RemoteAddr string `json:"_remoteAddr,omitempty"`
+}
+
+type HarNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HarRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	QueryString []HarNameValue `json:"queryString"`
+	PostData    *HarPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HarPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+
+	/*
+		`base64` for binary bodies. Not part of the spec, but understood by
+		common tools.
+	*/
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type HarResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HarNameValue `json:"cookies"`
+	Headers     []HarNameValue `json:"headers"`
+	Content     HarContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HarContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+/*
+Timings in milliseconds, -1 when not applicable.
+*/
+type HarTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func millis(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func harHeaders(header http.Header) []HarNameValue {
+	values := []HarNameValue{}
+	for name, vals := range header {
+		for _, val := range vals {
+			values = append(values, HarNameValue{Name: name, Value: val})
+		}
+	}
+	return values
+}
+
+func harCookies(cookies []*http.Cookie) []HarNameValue {
+	values := []HarNameValue{}
+	for _, cookie := range cookies {
+		values = append(values, HarNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return values
+}
+
+func encodeHarBody(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeHarBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// Requests reach the tunnel through the server, which may have terminated
+// tls, so the scheme is taken from X-Forwarded-Proto when present.
+func absoluteUrl(req *Request) string {
+	if strings.Contains(req.URL, "://") {
+		return req.URL
+	}
+	scheme := "http"
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + req.Host + req.URL
+}
+
+func harEntry(exchange *Exchange) HarEntry {
+	req := &exchange.Request
+	entry := HarEntry{
+		StartedDateTime: exchange.Start,
+		Time:            millis(exchange.Duration()),
+		RemoteAddr:      exchange.RemoteAddr,
+		Comment:         exchange.Error,
+		Timings:         HarTimings{Blocked: -1, DNS: -1, Connect: -1},
+	}
+
+	entry.Request = HarRequest{
+		Method:      req.Method,
+		URL:         absoluteUrl(req),
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies((&http.Request{Header: req.Header}).Cookies()),
+		Headers:     harHeaders(req.Header),
+		QueryString: []HarNameValue{},
+		HeadersSize: -1,
+		BodySize:    req.BodySize,
+	}
+	if parsed, err := url.ParseRequestURI(req.URL); err == nil {
+		for name, vals := range parsed.Query() {
+			for _, val := range vals {
+				entry.Request.QueryString = append(entry.Request.QueryString, HarNameValue{Name: name, Value: val})
+			}
+		}
+	}
+	if req.BodySize > 0 {
+		text, encoding := encodeHarBody(req.Body)
+		entry.Request.PostData = &HarPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+
+	if !exchange.RequestEnd.IsZero() {
+		entry.Timings.Send = millis(exchange.RequestEnd.Sub(exchange.Start))
+	}
+	resp := exchange.Response
+	if resp == nil {
+		// HAR has no notion of a missing response.
+		entry.Response = HarResponse{Cookies: []HarNameValue{}, Headers: []HarNameValue{}, HeadersSize: -1, BodySize: -1}
+		return entry
+	}
+	if !exchange.RequestEnd.IsZero() {
+		entry.Timings.Wait = millis(exchange.ResponseStart.Sub(exchange.RequestEnd))
+	}
+	if exchange.Done() {
+		entry.Timings.Receive = millis(exchange.End.Sub(exchange.ResponseStart))
+	}
+	text, encoding := encodeHarBody(resp.Body)
+	entry.Response = HarResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies((&http.Response{Header: resp.Header}).Cookies()),
+		Headers:     harHeaders(resp.Header),
+		Content: HarContent{
+			Size:     resp.BodySize,
+			MimeType: resp.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.BodySize,
+	}
+	return entry
+}
+
+/*
+ToHar converts exchanges into a HAR document.
+*/
+func ToHar(exchanges []Exchange) *Har {
+	har := &Har{Log: HarLog{
+		Version: "1.2",
+		Creator: HarCreator{Name: "pinggy-go inspector", Version: "1"},
+		Entries: make([]HarEntry, 0, len(exchanges)),
+	}}
+	for i := range exchanges {
+		har.Log.Entries = append(har.Log.Entries, harEntry(&exchanges[i]))
+	}
+	return har
+}
+
+/*
+ExportHar writes the recorded exchanges to w as a HAR document.
+*/
+func (in *Inspector) ExportHar(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ToHar(in.Exchanges()))
+}
+
+/*
+ExportHarFile writes the recorded exchanges to the file at path.
+*/
+func (in *Inspector) ExportHarFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = in.ExportHar(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func fromHarHeaders(values []HarNameValue) http.Header {
+	header := http.Header{}
+	for _, value := range values {
+		// HTTP/2 pseudo headers, as exported by browsers.
+		if strings.HasPrefix(value.Name, ":") {
+			continue
+		}
+		header.Add(value.Name, value.Value)
+	}
+	return header
+}
+
+/*
+Exchange converts a HAR entry back into an exchange.
+*/
+func (entry *HarEntry) Exchange() (Exchange, error) {
+	reqUrl, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return Exchange{}, fmt.Errorf("invalid request url %q: %v", entry.Request.URL, err)
+	}
+	header := fromHarHeaders(entry.Request.Headers)
+	host := header.Get("Host")
+	if host == "" {
+		host = reqUrl.Host
+	}
+	header.Del("Host")
+
+	exchange := Exchange{
+		RemoteAddr: entry.RemoteAddr,
+		Start:      entry.StartedDateTime,
+		Error:      entry.Comment,
+		Request: Request{
+			Method: entry.Request.Method,
+			URL:    reqUrl.RequestURI(),
+			Proto:  entry.Request.HTTPVersion,
+			Host:   host,
+			Header: header,
+		},
+	}
+	if entry.Request.PostData != nil {
+		body, err := decodeHarBody(entry.Request.PostData.Text, entry.Request.PostData.Encoding)
+		if err != nil {
+			return Exchange{}, fmt.Errorf("invalid request body: %v", err)
+		}
+		exchange.Request.Body = body
+	}
+	exchange.Request.BodySize = int64(len(exchange.Request.Body))
+	if entry.Request.BodySize > exchange.Request.BodySize {
+		exchange.Request.BodySize = entry.Request.BodySize
+		exchange.Request.BodyTruncated = true
+	}
+
+	ms := func(v float64) time.Duration {
+		if v < 0 {
+			return 0
+		}
+		return time.Duration(v * float64(time.Millisecond))
+	}
+	exchange.RequestEnd = exchange.Start.Add(ms(entry.Timings.Send))
+
+	if entry.Response.Status != 0 {
+		content := entry.Response.Content
+		body, err := decodeHarBody(content.Text, content.Encoding)
+		if err != nil {
+			return Exchange{}, fmt.Errorf("invalid response body: %v", err)
+		}
+		exchange.Response = &Response{
+			Proto:         entry.Response.HTTPVersion,
+			StatusCode:    entry.Response.Status,
+			Status:        strings.TrimSpace(fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText)),
+			Header:        fromHarHeaders(entry.Response.Headers),
+			Body:          body,
+			BodySize:      int64(len(body)),
+			BodyTruncated: content.Size > int64(len(body)),
+		}
+		if content.Size > exchange.Response.BodySize {
+			exchange.Response.BodySize = content.Size
+		}
+		exchange.ResponseStart = exchange.RequestEnd.Add(ms(entry.Timings.Wait))
+		exchange.End = exchange.ResponseStart.Add(ms(entry.Timings.Receive))
+	}
+	return exchange, nil
+}
+
+/*
+ReadHar parses a HAR document.
+*/
+func ReadHar(r io.Reader) (*Har, error) {
+	var har Har
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("invalid har document: %v", err)
+	}
+	return &har, nil
+}
+
+/*
+ImportHar loads the entries of a HAR document into the inspector, as if they
+were recorded, and returns their ids. They can then be replayed.
+*/
+func (in *Inspector) ImportHar(r io.Reader) ([]uint64, error) {
+	exchanges, err := in.importHar(r)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		ids = append(ids, exchange.ID)
+	}
+	return ids, nil
+}
+
+func (in *Inspector) importHar(r io.Reader) ([]Exchange, error) {
+	har, err := ReadHar(r)
+	if err != nil {
+		return nil, err
+	}
+	exchanges := make([]Exchange, 0, len(har.Log.Entries))
+	for i := range har.Log.Entries {
+		exchange, err := har.Log.Entries[i].Exchange()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	for i := range exchanges {
+		recorded := exchanges[i]
+		in.add(&recorded)
+		exchanges[i].ID = recorded.ID
+	}
+	return exchanges, nil
+}
+
+/*
+ReplayHar imports a HAR document and replays every request in order, modified
+by opts. It stops at the first request that cannot be sent.
+*/
+func (in *Inspector) ReplayHar(ctx context.Context, r io.Reader, opts ReplayOptions) ([]*ReplayResult, error) {
+	// Replayed from the parsed entries, the ring buffer may be too small to
+	// hold all of them.
+	exchanges, err := in.importHar(r)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*ReplayResult, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		result, err := in.replay(ctx, exchange, opts)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,106 @@
+package inspector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func recordedExchange() *Exchange {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	return &Exchange{
+		RemoteAddr: "203.0.113.7:5555",
+		Request: Request{
+			Method:   "POST",
+			URL:      "/hook?event=push",
+			Proto:    "HTTP/1.1",
+			Host:     "abc.a.pinggy.link",
+			Header:   http.Header{"Content-Type": {"application/octet-stream"}, "X-Forwarded-Proto": {"https"}},
+			Body:     []byte{0xff, 0x00, 0x01},
+			BodySize: 3,
+		},
+		Response: &Response{
+			Proto:      "HTTP/1.1",
+			StatusCode: 202,
+			Status:     "202 Accepted",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       []byte("ok"),
+			BodySize:   10,
+		},
+		Start:         start,
+		RequestEnd:    start.Add(2 * time.Millisecond),
+		ResponseStart: start.Add(5 * time.Millisecond),
+		End:           start.Add(6 * time.Millisecond),
+	}
+}
+
+func TestHarRoundTrip(t *testing.T) {
+	in := New(Config{})
+	in.add(recordedExchange())
+
+	var buf bytes.Buffer
+	if err := in.ExportHar(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &raw)
+	entry := raw["log"].(map[string]interface{})["entries"].([]interface{})[0].(map[string]interface{})
+	if entry["request"].(map[string]interface{})["url"] != "https://abc.a.pinggy.link/hook?event=push" {
+		t.Fatalf("unexpected url %v", entry["request"])
+	}
+	if entry["_remoteAddr"] != "203.0.113.7:5555" || entry["time"].(float64) != 6 {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+
+	imported := New(Config{})
+	ids, err := imported.ImportHar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange, ok := imported.Exchange(ids[0])
+	if !ok {
+		t.Fatal("imported exchange not found")
+	}
+	want := recordedExchange()
+	if exchange.Request.URL != want.Request.URL || exchange.Request.Host != want.Request.Host || !bytes.Equal(exchange.Request.Body, want.Request.Body) {
+		t.Fatalf("unexpected request %+v", exchange.Request)
+	}
+	if exchange.Response.Status != "202 Accepted" || !exchange.Response.BodyTruncated || exchange.Response.BodySize != 10 {
+		t.Fatalf("unexpected response %+v", exchange.Response)
+	}
+	if !exchange.Start.Equal(want.Start) || exchange.Duration() != want.Duration() || exchange.RemoteAddr != want.RemoteAddr {
+		t.Fatalf("unexpected timings %+v", exchange)
+	}
+}
+
+func TestReplayHar(t *testing.T) {
+	var paths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		paths = append(paths, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	har := ToHar([]Exchange{*recordedExchange(), *recordedExchange()})
+	har.Log.Entries[1].Request.URL = "https://abc.a.pinggy.link/second"
+	data, _ := json.Marshal(har)
+
+	in := New(Config{MaxExchanges: 1})
+	results, err := in.ReplayHar(context.Background(), bytes.NewReader(data), ReplayOptions{Target: backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || strings.Join(paths, " ") != "/hook?event=push /second" {
+		t.Fatalf("unexpected replay %v", paths)
+	}
+	if results[0].Replayed.Response.StatusCode != 200 || results[0].Original.Response.StatusCode != 202 {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Package inspector records the http exchanges flowing through a tunnel. It
+works locally on the connections of the tunnel, so no debugger is needed on
+the server side.
+
+	insp := inspector.New(inspector.Config{})
+	listener = insp.Listener(listener)
+	ui, err := insp.Start("localhost:4301")
+
+The recorded exchanges are available through Exchanges and the web ui. They
+can be replayed against the local backend and exported to or imported from
+HAR files.
+*/
+package inspector
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxExchanges = 100
+	DefaultMaxBodySize  = 64 * 1024
+)
+
+type Config struct {
+	/*
+		Number of exchanges kept. Older ones are dropped. Default 100.
+	*/
+	MaxExchanges int
+
+	/*
+		Number of body bytes recorded for every request and response. The rest
+		is forwarded but not recorded. Default 64KiB.
+	*/
+	MaxBodySize int
+}
+
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Proto  string      `json:"proto"`
+	Host   string      `json:"host"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+
+	/*
+		Size of the whole body, it may be larger than len(Body).
+	*/
+	BodySize      int64 `json:"bodySize"`
+	BodyTruncated bool  `json:"bodyTruncated"`
+}
+
+type Response struct {
+	Proto      string      `json:"proto"`
+	StatusCode int         `json:"statusCode"`
+	Status     string      `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+
+	/*
+		Size of the whole body, it may be larger than len(Body).
+	*/
+	BodySize      int64 `json:"bodySize"`
+	BodyTruncated bool  `json:"bodyTruncated"`
+}
+
+/*
+A request and its response. Response is nil until the response headers
+arrived.
+*/
+type Exchange struct {
+	ID uint64 `json:"id"`
+
+	/*
+		Address of the visitor.
+	*/
+	RemoteAddr string `json:"remoteAddr"`
+
+	Request  Request   `json:"request"`
+	Response *Response `json:"response"`
+
+	/*
+		When the request headers were received, the request body was
+		complete, the response headers were sent and the response was
+		complete. Zero until it happened.
+	*/
+	Start         time.Time `json:"start"`
+	RequestEnd    time.Time `json:"requestEnd"`
+	ResponseStart time.Time `json:"responseStart"`
+	End           time.Time `json:"end"`
+
+	/*
+		Set if the exchange could not be recorded completely.
+	*/
+	Error string `json:"error"`
+}
+
+/*
+Done reports whether the response is complete.
+*/
+func (e *Exchange) Done() bool {
+	return !e.End.IsZero()
+}
+
+/*
+Duration from the request headers to the end of the response.
+*/
+func (e *Exchange) Duration() time.Duration {
+	if e.End.IsZero() {
+		return 0
+	}
+	return e.End.Sub(e.Start)
+}
+
+type Inspector struct {
+	conf Config
+
+	mu            sync.Mutex
+	exchanges     []*Exchange
+	first         int
+	nextID        uint64
+	dropped       uint64
+	defaultTarget func() string
+}
+
+func New(conf Config) *Inspector {
+	if conf.MaxExchanges <= 0 {
+		conf.MaxExchanges = DefaultMaxExchanges
+	}
+	if conf.MaxBodySize <= 0 {
+		conf.MaxBodySize = DefaultMaxBodySize
+	}
+	return &Inspector{conf: conf}
+}
+
+/*
+Listener wraps l, so that the connections it accepts get inspected.
+*/
+func (in *Inspector) Listener(l net.Listener) net.Listener {
+	return &inspectingListener{Listener: l, inspector: in}
+}
+
+/*
+Exchanges returns a copy of the recorded exchanges, oldest first.
+*/
+func (in *Inspector) Exchanges() []Exchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	exchanges := make([]Exchange, 0, len(in.exchanges))
+	for i := range in.exchanges {
+		exchanges = append(exchanges, in.exchanges[(in.first+i)%len(in.exchanges)].clone())
+	}
+	return exchanges
+}
+
+/*
+Exchange returns a copy of the exchange with the given id, if it is still
+recorded.
+*/
+func (in *Inspector) Exchange(id uint64) (Exchange, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, exchange := range in.exchanges {
+		if exchange.ID == id {
+			return exchange.clone(), true
+		}
+	}
+	return Exchange{}, false
+}
+
+// clone copies e, which may still be updated, deeply enough that the copy
+// can be used without holding the lock. It expects in.mu to be held.
+func (e *Exchange) clone() Exchange {
+	clone := *e
+	clone.Request.Header = e.Request.Header.Clone()
+	if e.Response != nil {
+		response := *e.Response
+		response.Header = e.Response.Header.Clone()
+		clone.Response = &response
+	}
+	return clone
+}
+
+/*
+Clear drops every recorded exchange.
+*/
+func (in *Inspector) Clear() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.exchanges = nil
+	in.first = 0
+}
+
+// add stores a new exchange in the ring buffer, replacing the oldest one
+// once it is full.
+func (in *Inspector) add(exchange *Exchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.nextID += 1
+	exchange.ID = in.nextID
+	if len(in.exchanges) < in.conf.MaxExchanges {
+		in.exchanges = append(in.exchanges, exchange)
+		return
+	}
+	in.exchanges[in.first] = exchange
+	in.first = (in.first + 1) % len(in.exchanges)
+}
+
+/*
+Dropped returns the number of requests which were not recorded because
+their connection had too many requests waiting for a response. The
+traffic is not slowed down, the remaining requests of such a connection are
+not recorded either.
+*/
+func (in *Inspector) Dropped() uint64 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.dropped
+}
+
+func (in *Inspector) drop() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.dropped += 1
+}
+
+// update modifies a recorded exchange while holding the lock.
+func (in *Inspector) update(exchange *Exchange, change func(*Exchange)) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	change(exchange)
+}
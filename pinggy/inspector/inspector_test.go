@@ -0,0 +1,214 @@
+package inspector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveInspected(t *testing.T, in *Inspector, handler http.HandlerFunc) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(in.Listener(listener))
+	t.Cleanup(func() { server.Close() })
+	return "http://" + listener.Addr().String()
+}
+
+func waitDone(t *testing.T, in *Inspector, count int) []Exchange {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		exchanges := in.Exchanges()
+		done := 0
+		for i := range exchanges {
+			if exchanges[i].Done() {
+				done += 1
+			}
+		}
+		if done >= count {
+			return exchanges
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("exchanges not recorded: %+v", in.Exchanges())
+	return nil
+}
+
+func TestRecordsExchanges(t *testing.T) {
+	in := New(Config{MaxBodySize: 4})
+	url := serveInspected(t, in, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+
+	for _, body := range []string{"hello world", "hi"} {
+		resp, err := http.Post(url+"/hook?x=1", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	exchanges := waitDone(t, in, 2)
+	first := exchanges[0]
+	if first.Request.Method != "POST" || first.Request.URL != "/hook?x=1" {
+		t.Fatalf("unexpected request %+v", first.Request)
+	}
+	if string(first.Request.Body) != "hell" || first.Request.BodySize != 11 || !first.Request.BodyTruncated {
+		t.Fatalf("unexpected request body %q (%d bytes)", first.Request.Body, first.Request.BodySize)
+	}
+	if first.Response == nil || first.Response.StatusCode != http.StatusCreated || first.Response.Header.Get("X-Echo") != "yes" {
+		t.Fatalf("unexpected response %+v", first.Response)
+	}
+	if string(exchanges[1].Response.Body) != "hi" || exchanges[1].Response.BodyTruncated {
+		t.Fatalf("unexpected response body %q", exchanges[1].Response.Body)
+	}
+	if first.RemoteAddr == "" || first.Duration() <= 0 || exchanges[1].ID <= first.ID {
+		t.Fatalf("unexpected exchange %+v", first)
+	}
+}
+
+func TestExchangesWhileStreaming(t *testing.T) {
+	in := New(Config{})
+	url := serveInspected(t, in, func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 20; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(url + "/stream")
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	// Copies are read without the lock while the response is recorded.
+	for {
+		for _, exchange := range in.Exchanges() {
+			if exchange.Response != nil {
+				_ = exchange.Response.BodySize + int64(len(exchange.Response.Body))
+				_ = exchange.Response.Header.Get("Content-Type")
+			}
+			exchange.Summary()
+		}
+		select {
+		case <-done:
+			if exchanges := waitDone(t, in, 1); exchanges[0].Response.BodySize != 100 {
+				t.Fatalf("unexpected response %+v", exchanges[0].Response)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	in := New(Config{MaxExchanges: 2})
+	for i := 0; i < 5; i++ {
+		in.add(&Exchange{})
+	}
+	exchanges := in.Exchanges()
+	if len(exchanges) != 2 || exchanges[0].ID != 4 || exchanges[1].ID != 5 {
+		t.Fatalf("unexpected exchanges %+v", exchanges)
+	}
+	if _, ok := in.Exchange(3); ok {
+		t.Fatal("dropped exchange still available")
+	}
+	in.Clear()
+	if len(in.Exchanges()) != 0 {
+		t.Fatal("exchanges not cleared")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	in := New(Config{})
+	in.add(&Exchange{Request: Request{Method: "GET", URL: "/a"}, Response: &Response{StatusCode: 200}})
+	server := httptest.NewServer(in.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/exchanges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summaries []ExchangeSummary
+	json.NewDecoder(resp.Body).Decode(&summaries)
+	resp.Body.Close()
+	if len(summaries) != 1 || summaries[0].URL != "/a" || summaries[0].StatusCode != 200 {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+
+	resp, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "Pinggy inspector") {
+		t.Fatal("ui not served")
+	}
+}
+
+func TestPipelinedRequestsDoNotBlock(t *testing.T) {
+	in := New(Config{MaxExchanges: 1000})
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := in.Conn(local)
+	defer conn.Close()
+
+	// The backend reads more pipelined requests than can wait for a
+	// response, without answering any of them.
+	var requests strings.Builder
+	for i := 0; i < 2*maxPendingExchanges; i++ {
+		fmt.Fprintf(&requests, "GET /%d HTTP/1.1\r\nHost: example.com\r\n\r\n", i)
+	}
+	go io.WriteString(remote, requests.String())
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(conn, make([]byte, requests.Len()))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("traffic blocked by the inspection")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for in.Dropped() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := in.Dropped(); dropped != 1 {
+		t.Fatalf("expected a dropped request, got %d", dropped)
+	}
+	// The response parser may hold one more request than the queue.
+	exchanges := in.Exchanges()
+	if len(exchanges) < maxPendingExchanges || len(exchanges) > maxPendingExchanges+1 {
+		t.Fatalf("expected %d exchanges, got %d", maxPendingExchanges, len(exchanges))
+	}
+	for i, exchange := range exchanges {
+		if url := exchange.Request.URL; url != fmt.Sprintf("/%d", i) {
+			t.Fatalf("unexpected request %d: %s", i, url)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package inspector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Changes applied to a recorded request before replaying it. Empty fields keep
+the recorded values.
+*/
+type ReplayOptions struct {
+	/*
+		Where to send the request, `host:port` or a base url like
+		`https://localhost:8443`. Defaults to the forwarding address of the
+		tunnel, if any.
+	*/
+	Target string `json:"target"`
+
+	Method string `json:"method"`
+
+	/*
+		Path and query, e.g. `/hooks/github?retry=1`.
+	*/
+	Path string `json:"path"`
+
+	/*
+		Headers replacing the recorded ones with the same name.
+	*/
+	Header http.Header `json:"header"`
+
+	/*
+		Names of recorded headers to drop.
+	*/
+	RemoveHeaders []string `json:"removeHeaders"`
+
+	/*
+		Replace the recorded body by Body, which may be empty.
+	*/
+	SetBody bool   `json:"setBody"`
+	Body    []byte `json:"body"`
+}
+
+/*
+The recorded exchange and the one produced by replaying it.
+*/
+type ReplayResult struct {
+	Original Exchange `json:"original"`
+	Replayed Exchange `json:"replayed"`
+}
+
+// Hop-by-hop headers and headers computed by the http client.
+var skippedHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+/*
+SetDefaultTarget sets the function returning the target used when
+ReplayOptions.Target is empty.
+*/
+func (in *Inspector) SetDefaultTarget(target func() string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.defaultTarget = target
+}
+
+func (in *Inspector) replayTarget() string {
+	in.mu.Lock()
+	defaultTarget := in.defaultTarget
+	in.mu.Unlock()
+	if defaultTarget == nil {
+		return ""
+	}
+	return defaultTarget()
+}
+
+/*
+Replay sends the recorded request with the given id again, modified by opts.
+*/
+func (in *Inspector) Replay(ctx context.Context, id uint64, opts ReplayOptions) (*ReplayResult, error) {
+	original, ok := in.Exchange(id)
+	if !ok {
+		return nil, fmt.Errorf("exchange %d is not recorded", id)
+	}
+	return in.replay(ctx, original, opts)
+}
+
+func (in *Inspector) replay(ctx context.Context, original Exchange, opts ReplayOptions) (*ReplayResult, error) {
+	if !opts.SetBody {
+		if original.RequestEnd.IsZero() {
+			return nil, fmt.Errorf("the request of exchange %d is still being received", original.ID)
+		}
+		if original.Request.BodyTruncated {
+			return nil, fmt.Errorf("the body of exchange %d was only recorded partially, provide a body to replay it", original.ID)
+		}
+	}
+	if opts.Target == "" {
+		opts.Target = in.replayTarget()
+	}
+
+	request := original.Request
+	request.Header = request.Header.Clone()
+	if opts.Method != "" {
+		request.Method = opts.Method
+	}
+	if opts.Path != "" {
+		request.URL = opts.Path
+	}
+	for _, name := range opts.RemoveHeaders {
+		request.Header.Del(name)
+	}
+	for name, values := range opts.Header {
+		request.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if opts.SetBody {
+		request.Body = opts.Body
+		request.BodySize = int64(len(opts.Body))
+		request.BodyTruncated = false
+	}
+
+	replayed, err := in.Send(ctx, opts.Target, request)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayResult{Original: original, Replayed: *replayed}, nil
+}
+
+/*
+Send sends request to target, `host:port` or a base url, and records the
+response. The Host header of the request is kept, so that virtual hosts work.
+*/
+func (in *Inspector) Send(ctx context.Context, target string, request Request) (*Exchange, error) {
+	if target == "" {
+		return nil, fmt.Errorf("no target to send the request to")
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	path := request.URL
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, strings.TrimSuffix(target, "/")+path, bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range request.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	for _, name := range skippedHeaders {
+		req.Header.Del(name)
+	}
+	if request.Host != "" {
+		req.Host = request.Host
+	}
+
+	exchange := &Exchange{
+		RemoteAddr: "replay",
+		Request:    request,
+		Start:      time.Now(),
+	}
+	resp, err := replayClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	exchange.RequestEnd = exchange.Start
+	exchange.ResponseStart = time.Now()
+
+	recorder := &bodyRecorder{max: in.conf.MaxBodySize}
+	_, err = io.Copy(recorder, resp.Body)
+	exchange.End = time.Now()
+	exchange.Response = &Response{
+		Proto:         resp.Proto,
+		StatusCode:    resp.StatusCode,
+		Status:        resp.Status,
+		Header:        resp.Header,
+		Body:          recorder.body,
+		BodySize:      recorder.size,
+		BodyTruncated: recorder.truncated(),
+	}
+	if err != nil {
+		exchange.Error = "incomplete response body: " + err.Error()
+	}
+	return exchange, nil
+}
+
+var replayClient = &http.Client{
+	Transport: &http.Transport{
+		// The recorded Accept-Encoding is sent as is, the body is kept as
+		// received.
+		DisableCompression: true,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
@@ -0,0 +1,135 @@
+package inspector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	in := New(Config{})
+	var got *http.Request
+	var gotBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got, gotBody = r, string(body)
+		w.Write([]byte("replayed " + r.URL.Path))
+	}))
+	defer backend.Close()
+	in.SetDefaultTarget(func() string { return strings.TrimPrefix(backend.URL, "http://") })
+
+	in.add(&Exchange{
+		Request: Request{
+			Method:   "POST",
+			URL:      "/hook",
+			Host:     "abc.a.pinggy.link",
+			Header:   http.Header{"X-Signature": {"old"}, "X-Drop": {"1"}, "Connection": {"close"}},
+			Body:     []byte("payload"),
+			BodySize: 7,
+		},
+		Response:   &Response{StatusCode: 500},
+		RequestEnd: time.Now(),
+	})
+
+	result, err := in.Replay(context.Background(), 1, ReplayOptions{
+		Path:          "/hook?retry=1",
+		Header:        http.Header{"x-signature": {"new"}},
+		RemoveHeaders: []string{"X-Drop"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.String() != "/hook?retry=1" || got.Host != "abc.a.pinggy.link" || gotBody != "payload" {
+		t.Fatalf("unexpected request %v %v %q", got.URL, got.Host, gotBody)
+	}
+	if got.Header.Get("X-Signature") != "new" || got.Header.Get("X-Drop") != "" {
+		t.Fatalf("unexpected headers %v", got.Header)
+	}
+	if result.Original.Response.StatusCode != 500 || result.Replayed.Response.StatusCode != 200 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if string(result.Replayed.Response.Body) != "replayed /hook" {
+		t.Fatalf("unexpected body %q", result.Replayed.Response.Body)
+	}
+
+	// Through the api, with a new body.
+	server := httptest.NewServer(in.Handler())
+	defer server.Close()
+	opts, _ := json.Marshal(ReplayOptions{SetBody: true, Body: []byte("edited")})
+	resp, err := http.Post(server.URL+"/api/exchanges/1/replay", "application/json", bytes.NewReader(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || gotBody != "edited" {
+		t.Fatalf("unexpected replay %v %q", resp.Status, gotBody)
+	}
+}
+
+func TestReplayTruncatedBody(t *testing.T) {
+	in := New(Config{})
+	in.add(&Exchange{Request: Request{Method: "POST", URL: "/", BodyTruncated: true}, RequestEnd: time.Now()})
+	if _, err := in.Replay(context.Background(), 1, ReplayOptions{Target: "localhost:1"}); err == nil {
+		t.Fatal("replayed a truncated body")
+	}
+	if _, err := in.Replay(context.Background(), 2, ReplayOptions{}); err == nil {
+		t.Fatal("replayed an unknown exchange")
+	}
+}
+
+func TestReplayApiRejectsForeignRequests(t *testing.T) {
+	in := New(Config{})
+	in.SetDefaultTarget(func() string { return "localhost:1" })
+	in.add(&Exchange{Request: Request{Method: "GET", URL: "/"}, RequestEnd: time.Now()})
+	ui, err := in.StartUI(UIConfig{Addr: "127.0.0.1:0", Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ui.Close()
+	url := "http://" + ui.Addr().String()
+
+	post := func(path, contentType, origin, body string) int {
+		req, _ := http.NewRequest("POST", url+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", contentType)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		path, contentType, origin, body string
+		status                          int
+	}{
+		{"/api/exchanges/1/replay", "text/plain", "", "{}", http.StatusUnsupportedMediaType},
+		{"/api/har", "text/plain", "", "{}", http.StatusUnsupportedMediaType},
+		{"/api/exchanges/1/replay", "application/json", "https://attacker.example", "{}", http.StatusForbidden},
+		{"/api/exchanges/1/replay", "application/json", "", `{"target":"attacker.example:443"}`, http.StatusForbidden},
+	}
+	for i, test := range tests {
+		if status := post(test.path, test.contentType, test.origin, test.body); status != test.status {
+			t.Errorf("%d: got status %d, expected %d", i, status, test.status)
+		}
+	}
+
+	resp, err := http.Get(url + "/api/exchanges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request got status %d", resp.StatusCode)
+	}
+}
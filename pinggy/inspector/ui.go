@@ -0,0 +1,260 @@
+package inspector
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/webauth"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+/*
+Default address of the web ui. It is reachable from this machine only.
+*/
+const DefaultUIAddr = "localhost:4301"
+
+/*
+Short form of an exchange, as listed by the web ui.
+*/
+type ExchangeSummary struct {
+	ID           uint64        `json:"id"`
+	RemoteAddr   string        `json:"remoteAddr"`
+	Method       string        `json:"method"`
+	URL          string        `json:"url"`
+	Host         string        `json:"host"`
+	StatusCode   int           `json:"statusCode"`
+	Start        time.Time     `json:"start"`
+	Duration     time.Duration `json:"duration"`
+	RequestSize  int64         `json:"requestSize"`
+	ResponseSize int64         `json:"responseSize"`
+	Error        string        `json:"error"`
+}
+
+func (e *Exchange) Summary() ExchangeSummary {
+	summary := ExchangeSummary{
+		ID:          e.ID,
+		RemoteAddr:  e.RemoteAddr,
+		Method:      e.Request.Method,
+		URL:         e.Request.URL,
+		Host:        e.Request.Host,
+		Start:       e.Start,
+		Duration:    e.Duration(),
+		RequestSize: e.Request.BodySize,
+		Error:       e.Error,
+	}
+	if e.Response != nil {
+		summary.StatusCode = e.Response.StatusCode
+		summary.ResponseSize = e.Response.BodySize
+	}
+	return summary
+}
+
+/*
+Handler serves the web ui and its json api. Requests from other web sites
+are rejected, and request bodies have to be application/json.
+
+	GET    /api/exchanges       summaries, oldest first
+	GET    /api/exchanges/{id}  a whole exchange, bodies base64 encoded
+	DELETE /api/exchanges       drop every exchange
+	POST   /api/exchanges/{id}/replay
+	                            replay it, the body holds ReplayOptions and
+	                            the response the ReplayResult. The target can
+	                            only be the default one, other targets need
+	                            the Replay method.
+	GET    /api/har             every exchange as a HAR document
+	POST   /api/har             import a HAR document, returns the new ids
+*/
+func (in *Inspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/exchanges", in.serveExchanges)
+	mux.HandleFunc("/api/exchanges/", in.serveExchange)
+	mux.HandleFunc("/api/har", in.serveHar)
+	api := mux
+
+	mux = http.NewServeMux()
+	mux.Handle("/api/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !webauth.SameOrigin(w, r) {
+			return
+		}
+		if r.Method == http.MethodPost && !webauth.JsonBody(w, r) {
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+
+	static, _ := fs.Sub(uiFiles, "ui")
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	return mux
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (in *Inspector) serveExchanges(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		exchanges := in.Exchanges()
+		summaries := make([]ExchangeSummary, 0, len(exchanges))
+		for i := range exchanges {
+			summaries = append(summaries, exchanges[i].Summary())
+		}
+		writeJson(w, summaries)
+	case http.MethodDelete:
+		in.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (in *Inspector) serveExchange(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/exchanges/")
+	replay := strings.HasSuffix(path, "/replay")
+	id, err := strconv.ParseUint(strings.TrimSuffix(path, "/replay"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid exchange id", http.StatusBadRequest)
+		return
+	}
+	if replay {
+		in.serveReplay(w, r, id)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	exchange, ok := in.Exchange(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJson(w, exchange)
+}
+
+const maxHarSize = 64 << 20
+
+func (in *Inspector) serveHar(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="pinggy.har"`)
+		in.ExportHar(w)
+	case http.MethodPost:
+		ids, err := in.ImportHar(http.MaxBytesReader(w, r.Body, maxHarSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, ids)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const replayTimeout = 30 * time.Second
+
+func (in *Inspector) serveReplay(w http.ResponseWriter, r *http.Request, id uint64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var opts ReplayOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, "invalid replay options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if opts.Target != "" && opts.Target != in.replayTarget() {
+		http.Error(w, "the replay target can only be changed through the Replay method", http.StatusForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), replayTimeout)
+	defer cancel()
+	result, err := in.Replay(ctx, id, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJson(w, result)
+}
+
+/*
+A running web ui.
+*/
+type UI struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+type UIConfig struct {
+	/*
+		Address to listen at. Default DefaultUIAddr.
+	*/
+	Addr string
+
+	/*
+		Require basic authentication with these credentials. Both have to be set.
+	*/
+	Username string
+	Password string
+
+	/*
+		Require this token, passed either as `Authorization: Bearer <token>` or
+		once as `?token=<token>` query parameter, which is then kept in a cookie.
+	*/
+	Token string
+}
+
+/*
+Start serves the web ui at addr, DefaultUIAddr if empty, in the background.
+*/
+func (in *Inspector) Start(addr string) (*UI, error) {
+	return in.StartUI(UIConfig{Addr: addr})
+}
+
+/*
+StartUI serves the web ui in the background, with the optional
+authentication of conf.
+*/
+func (in *Inspector) StartUI(conf UIConfig) (*UI, error) {
+	auth := webauth.Config{
+		Username:   conf.Username,
+		Password:   conf.Password,
+		Token:      conf.Token,
+		Realm:      "pinggy inspector",
+		CookieName: "pinggy_inspector_token",
+	}
+	if err := auth.Verify(); err != nil {
+		return nil, err
+	}
+	if conf.Addr == "" {
+		conf.Addr = DefaultUIAddr
+	}
+	listener, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ui := &UI{listener: listener, server: &http.Server{Handler: auth.Handler(in.Handler())}}
+	go ui.server.Serve(listener)
+	return ui, nil
+}
+
+func (ui *UI) Addr() net.Addr {
+	return ui.listener.Addr()
+}
+
+func (ui *UI) Close() error {
+	return ui.server.Close()
+}
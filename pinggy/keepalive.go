@@ -0,0 +1,95 @@
+package pinggy
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+KeepAliveTimeoutError is reported when the server stops answering keepalive
+requests and the connection is considered dead.
+*/
+type KeepAliveTimeoutError struct {
+	/*
+		Number of consecutive keepalive requests that were not answered.
+	*/
+	Missed int
+
+	/*
+		Interval between two keepalive requests.
+	*/
+	Interval time.Duration
+}
+
+func (e *KeepAliveTimeoutError) Error() string {
+	return fmt.Sprintf("server did not answer %d keepalive requests sent every %v", e.Missed, e.Interval)
+}
+
+func (e *KeepAliveTimeoutError) Timeout() bool { return true }
+
+// The connection is gone for good, servers must not retry Accept.
+func (e *KeepAliveTimeoutError) Temporary() bool { return false }
+
+func (tun *sshTunnel) roundTripTime() time.Duration {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return tun.rtt
+}
+
+func (tun *sshTunnel) keepAliveErr() error {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return tun.err
+}
+
+/*
+keepAlive periodically sends `keepalive@openssh.com` requests to the server and
+closes the connection once `maxMissed` requests in a row were not answered
+within the interval.
+*/
+func (tun *sshTunnel) keepAlive(conf *Config) {
+	interval := conf.KeepAliveInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-tun.done:
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			_, _, err := tun.clientConn.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case <-tun.done:
+			return
+		case err := <-replied:
+			if err != nil {
+				// The connection is already gone.
+				return
+			}
+			missed = 0
+			tun.mu.Lock()
+			tun.rtt = time.Since(start)
+			tun.mu.Unlock()
+		case <-time.After(interval):
+			missed += 1
+			conf.log.Warn("keepalive request not answered", "missed", missed, "max", conf.KeepAliveMaxMissed)
+			if missed >= conf.KeepAliveMaxMissed {
+				tun.mu.Lock()
+				tun.err = &KeepAliveTimeoutError{Missed: missed, Interval: interval}
+				tun.mu.Unlock()
+				conf.log.Error("server is not responding, closing the connection")
+				tun.close()
+				return
+			}
+		}
+	}
+}
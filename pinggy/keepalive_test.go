@@ -0,0 +1,68 @@
+package pinggy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveRoundTripTime(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{KeepAliveInterval: 20 * time.Millisecond})
+	waitFor(t, "a keepalive reply", func() bool {
+		return pl.RoundTripTime() > 0
+	})
+
+	// Without keepalives, the round trip time is never measured.
+	pl = s.connect(t, Config{})
+	time.Sleep(50 * time.Millisecond)
+	if rtt := pl.RoundTripTime(); rtt != 0 {
+		t.Fatalf("unexpected round trip time %v", rtt)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{KeepAliveInterval: 20 * time.Millisecond, KeepAliveMaxMissed: 2})
+	s.setNoReply(true)
+
+	_, err := pl.Accept()
+	var kerr *KeepAliveTimeoutError
+	if !errors.As(err, &kerr) {
+		t.Fatalf("expected a KeepAliveTimeoutError, got %v", err)
+	}
+	if kerr.Missed != 2 || kerr.Interval != 20*time.Millisecond {
+		t.Fatalf("unexpected error %+v", kerr)
+	}
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() || nerr.Temporary() {
+		t.Fatal("expected a permanent timeout")
+	}
+
+	// The listener stays closed.
+	if _, err := pl.Accept(); !errors.As(err, &kerr) {
+		t.Fatalf("expected a KeepAliveTimeoutError, got %v", err)
+	}
+}
+
+func TestKeepAliveTimeoutStopsServe(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{KeepAliveInterval: 20 * time.Millisecond, KeepAliveMaxMissed: 2})
+	served := make(chan error, 1)
+	go func() {
+		served <- http.Serve(pl, http.NotFoundHandler())
+	}()
+	s.setNoReply(true)
+
+	select {
+	case err := <-served:
+		var kerr *KeepAliveTimeoutError
+		if !errors.As(err, &kerr) {
+			t.Fatalf("expected a KeepAliveTimeoutError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("http.Serve keeps retrying on a dead tunnel")
+	}
+}
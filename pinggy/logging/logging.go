@@ -0,0 +1,124 @@
+/*
+Package logging provides the small leveled logger interface used across the
+pinggy packages, a no-op implementation and an adapter for the standard
+library logger.
+*/
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+/*
+Logger receives log messages with a level and optional key/value pairs, e.g.
+
+	logger.Info("tunnel established", "server", "a.pinggy.io", "port", 443)
+*/
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+/*
+LoggerFunc turns a single function into a Logger.
+*/
+type LoggerFunc func(level Level, msg string, keyvals ...interface{})
+
+func (f LoggerFunc) Debug(msg string, keyvals ...interface{}) { f(LevelDebug, msg, keyvals...) }
+func (f LoggerFunc) Info(msg string, keyvals ...interface{})  { f(LevelInfo, msg, keyvals...) }
+func (f LoggerFunc) Warn(msg string, keyvals ...interface{})  { f(LevelWarn, msg, keyvals...) }
+func (f LoggerFunc) Error(msg string, keyvals ...interface{}) { f(LevelError, msg, keyvals...) }
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+/*
+Nop returns a Logger discarding everything. It is the default everywhere.
+*/
+func Nop() Logger {
+	return nopLogger{}
+}
+
+/*
+NewStdLogger writes messages of at least minLevel to the standard library
+logger l, formatted as `LEVEL msg key=value ...`. If l is nil, the default
+standard logger is used.
+*/
+func NewStdLogger(l *log.Logger, minLevel Level) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return LoggerFunc(func(level Level, msg string, keyvals ...interface{}) {
+		if level < minLevel {
+			return
+		}
+		l.Output(3, Format(level, msg, keyvals...))
+	})
+}
+
+/*
+Format renders a message the way NewStdLogger prints it.
+*/
+func Format(level Level, msg string, keyvals ...interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		sb.WriteByte(' ')
+		sb.WriteString(fmt.Sprint(keyvals[i]))
+		sb.WriteByte('=')
+		if i+1 < len(keyvals) {
+			val := fmt.Sprint(keyvals[i+1])
+			if strings.ContainsAny(val, " \t\n\"") {
+				val = fmt.Sprintf("%q", val)
+			}
+			sb.WriteString(val)
+		} else {
+			sb.WriteString("(MISSING)")
+		}
+	}
+	return sb.String()
+}
+
+/*
+OrNop returns l, or a no-op logger if l is nil.
+*/
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop()
+	}
+	return l
+}
@@ -1,74 +1,202 @@
 package pinggy
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+	"github.com/Pinggy-io/pinggy-go/pinggy/proxyproto"
 	"golang.org/x/crypto/ssh"
 )
 
-func (conf *Config) verify() {
+func (conf *Config) verify() error {
+	conf.log = logging.Nop()
+	if conf.LeveledLogger != nil {
+		conf.log = conf.LeveledLogger
+	} else if conf.Logger != nil {
+		conf.log = logging.NewStdLogger(conf.Logger, logging.LevelInfo)
+	}
+
+	cerr := &ConfigError{}
+
 	if conf.Server == "" {
 		conf.Server = "a.pinggy.io"
 	}
-	addr := strings.Split(conf.Server, ":")
-	conf.port = 443
-	conf.Server = addr[0]
-	if len(addr) > 1 {
-		p, err := strconv.Atoi(addr[1])
-		if err != nil {
-			conf.Logger.Fatal(err)
-		}
-		conf.port = p
-	}
-	if conf.Logger == nil {
-		conf.Logger = log.Default()
+	host, port, err := parseServerAddr(conf.Server)
+	if err != nil {
+		cerr.add("Server", "invalid server address %q: %v", conf.Server, err)
 	}
+	conf.Server = host
+	conf.port = port
 
-	ctype := conf.Type
-	switch ctype {
-	case HTTP, TCP, TLS, TLSTCP:
-		conf.Type = ctype
+	switch conf.Type {
+	case HTTP, TCP, TLS, TLSTCP, "":
 	default:
-		conf.Type = ""
+		cerr.add("Type", "unknown tunnel type %q", conf.Type)
 	}
-	atype := conf.AltType
-	conf.AltType = ""
-	switch atype {
-	case UDP:
-		conf.AltType = UDP
+	switch conf.AltType {
+	case UDP, "":
 	default:
-		conf.AltType = ""
+		cerr.add("AltType", "unknown alternate tunnel type %q", conf.AltType)
 	}
 
-	// if conf.Type != "" && conf.AltType != "" {
-	// 	conf.AltType = ""
-	// }
-
 	if conf.Type == "" && conf.AltType == "" {
 		conf.Type = HTTP
 	}
 
+	if conf.Inspector != nil && conf.Type != HTTP {
+		cerr.add("Inspector", "inspection is available only with %v mode", HTTP)
+	}
+
+	if conf.TlsTermination != nil {
+		verifyTlsTermination(cerr, conf)
+	}
+
+	if conf.TcpForwardingAddr != "" {
+		if conf.Type == "" {
+			cerr.add("TcpForwardingAddr", "tcp forwarding requires a tunnel Type")
+		}
+		verifyForwardingAddr(cerr, "TcpForwardingAddr", conf.TcpForwardingAddr)
+	}
+	if conf.TcpLoadBalancer != nil {
+		if conf.TcpForwardingAddr != "" {
+			cerr.add("TcpLoadBalancer", "cannot be used together with TcpForwardingAddr")
+		}
+		if conf.Type == "" {
+			cerr.add("TcpLoadBalancer", "tcp forwarding requires a tunnel Type")
+		}
+		for i, backend := range conf.TcpLoadBalancer.Backends {
+			verifyForwardingAddr(cerr, fmt.Sprintf("TcpLoadBalancer.Backends[%d].Addr", i), backend.Addr)
+		}
+		if err := conf.TcpLoadBalancer.Verify(); err != nil {
+			cerr.add("TcpLoadBalancer", "%v", err)
+		}
+	}
+	switch conf.TcpProxyProtocol {
+	case 0:
+	case proxyproto.V1, proxyproto.V2:
+		if conf.TcpForwardingAddr == "" && conf.TcpLoadBalancer == nil {
+			cerr.add("TcpProxyProtocol", "proxy protocol requires TcpForwardingAddr or TcpLoadBalancer")
+		}
+	default:
+		cerr.add("TcpProxyProtocol", "unknown proxy protocol version %d", conf.TcpProxyProtocol)
+	}
+	if conf.ForwardingLimits != nil {
+		if err := conf.ForwardingLimits.Verify(); err != nil {
+			cerr.add("ForwardingLimits", "%v", err)
+		}
+	}
+	if conf.Bandwidth != nil {
+		if err := conf.Bandwidth.Verify(); err != nil {
+			cerr.add("Bandwidth", "%v", err)
+		}
+	}
+	if conf.UdpForwardingAddr != "" {
+		if conf.AltType != UDP {
+			cerr.add("UdpForwardingAddr", "udp forwarding requires AltType %q", UDP)
+		}
+		verifyForwardingAddr(cerr, "UdpForwardingAddr", conf.UdpForwardingAddr)
+	}
+
+	verifyWhiteList(cerr, conf.IpWhiteList)
+
 	conf.startSession = false
 	if len(conf.IpWhiteList) > 0 {
 		conf.startSession = true
 	}
 	if conf.HeaderManipulationAndAuth != nil {
-		for _, hman := range conf.HeaderManipulationAndAuth.Headers {
-			if strings.ToLower(hman.Key) == "host" {
-				conf.Logger.Fatalln("host header is not allowed here")
-			}
+		verifyHeaderManipulation(cerr, "HeaderManipulationAndAuth", conf.HeaderManipulationAndAuth)
+		conf.startSession = true
+	}
+
+	if conf.Proxy != "" {
+		if _, err := parseProxyUrl(conf.Proxy); err != nil {
+			cerr.add("Proxy", "%v", err)
 		}
+	}
 
-		conf.startSession = true
+	for i, fingerprint := range conf.HostKeyFingerprints {
+		if !isFingerprint(fingerprint) {
+			cerr.add(fmt.Sprintf("HostKeyFingerprints[%d]", i), "invalid fingerprint %q", fingerprint)
+		}
 	}
+
+	if conf.Timeout < 0 {
+		cerr.add("Timeout", "must not be negative")
+	}
+	if conf.KeepAliveInterval < 0 {
+		cerr.add("KeepAliveInterval", "must not be negative")
+	}
+	if conf.Reconnect != nil && conf.Reconnect.MaxAttempts < 0 {
+		cerr.add("Reconnect.MaxAttempts", "must not be negative")
+	}
+
+	if conf.KeepAliveMaxMissed <= 0 {
+		conf.KeepAliveMaxMissed = 3
+	}
+
+	if conf.TrustOnFirstUse && conf.KnownHostsFile == "" {
+		conf.KnownHostsFile = defaultKnownHostsFile()
+	}
+
+	if conf.Reconnect != nil {
+		reconnect := *conf.Reconnect
+		if reconnect.InitialBackoff <= 0 {
+			reconnect.InitialBackoff = time.Second
+		}
+		if reconnect.MaxBackoff <= 0 {
+			reconnect.MaxBackoff = time.Minute
+		}
+		if reconnect.MaxBackoff < reconnect.InitialBackoff {
+			reconnect.MaxBackoff = reconnect.InitialBackoff
+		}
+		if reconnect.Multiplier < 1 {
+			reconnect.Multiplier = 2
+		}
+		conf.Reconnect = &reconnect
+	}
+
+	return cerr.errOrNil()
 }
 
-func dialWithConfig(conf *Config) (*ssh.Client, error) {
+func (conf *Config) serverAddr() string {
+	return net.JoinHostPort(conf.Server, strconv.Itoa(conf.port))
+}
+
+/*
+closeOnCancel closes c as soon as ctx is done. Calling the returned function
+stops watching the context; it reports whether c was closed because of ctx.
+*/
+func closeOnCancel(ctx context.Context, c io.Closer) (stop func() bool) {
+	done := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			cancelled <- true
+		case <-done:
+			cancelled <- false
+		}
+	}()
+	var once sync.Once
+	var result bool
+	return func() bool {
+		once.Do(func() {
+			close(done)
+			result = <-cancelled
+		})
+		return result
+	}
+}
+
+func dialWithConfig(ctx context.Context, conf *Config) (*ssh.Client, error) {
 	user := "auth"
 	if conf.Type != "" {
 		user += "+" + string(conf.Type)
@@ -79,36 +207,74 @@ func dialWithConfig(conf *Config) (*ssh.Client, error) {
 	if conf.Token != "" {
 		user = conf.Token + "+" + user
 	}
-	clientConfig := &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.Password("nopass"),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	auth, cleanupAuth, err := authMethods(conf)
+	if err != nil {
+		conf.log.Error("error in ssh connection initiation", "err", err)
+		return nil, err
 	}
-	usingToken := "without using any token"
-	if conf.Token != "" {
-		usingToken = fmt.Sprintf("using token: %s", conf.Token)
+	defer cleanupAuth()
+	hostKeyVerifier := newHostKeyVerifier(conf)
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyVerifier.callback(),
 	}
-	conf.Logger.Printf("Initiating ssh connection %s to server: %s:%d\n", usingToken, conf.Server, conf.port)
+	conf.log.Info("initiating ssh connection", "server", conf.Server, "port", conf.port, "withToken", conf.Token != "")
 
-	addr := fmt.Sprintf("%s:%d", conf.Server, conf.port)
-	conn, err := net.DialTimeout("tcp", addr, conf.Timeout)
+	addr := conf.serverAddr()
+	proxyUrl, err := proxyForServer(conf, addr)
+	if err != nil {
+		conf.log.Error("error in ssh connection initiation", "err", err)
+		return nil, err
+	}
+	dialAddr := addr
+	if proxyUrl != nil {
+		dialAddr = proxyAddr(proxyUrl)
+		conf.log.Info("connecting through proxy", "proxy", dialAddr)
+	}
+	dialer := net.Dialer{Timeout: conf.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", dialAddr)
 	if err != nil {
-		conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
+		conf.log.Error("error in ssh connection initiation", "err", err)
 		return nil, err
 	}
+	// The watcher covers the proxy, the tls and the ssh handshake.
+	stop := closeOnCancel(ctx, conn)
+	if proxyUrl != nil {
+		proxyConn, err := connectThroughProxy(ctx, conn, proxyUrl, addr)
+		if err != nil {
+			if stop() {
+				err = ctx.Err()
+			}
+			conn.Close()
+			conf.log.Error("error in ssh connection initiation", "err", err)
+			return nil, err
+		}
+		conn = proxyConn
+	}
 	if conf.SshOverSsl {
 		tlsConn := tls.Client(conn, &tls.Config{ServerName: conf.Server})
 		err := tlsConn.Handshake()
 		if err != nil {
-			conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
+			if stop() {
+				err = ctx.Err()
+			}
+			conn.Close()
+			conf.log.Error("error in ssh connection initiation", "err", err)
 			return nil, err
 		}
 		conn = tlsConn
 	}
 	c, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		if hostKeyVerifier.err != nil {
+			err = hostKeyVerifier.err
+		}
+		conf.log.Error("error in ssh connection initiation", "err", err)
 		return nil, err
 	}
 
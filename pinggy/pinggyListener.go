@@ -1,9 +1,8 @@
 package pinggy
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -12,26 +11,69 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Pinggy-io/pinggy-go/pinggy/control"
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/inspector"
+	"github.com/Pinggy-io/pinggy-go/pinggy/servermsg"
 	"github.com/Pinggy-io/pinggy-go/pinggy/socks"
 	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
 	"golang.org/x/crypto/ssh"
 )
 
 type pinggyListener struct {
-	conf          *Config
-	clientConn    *ssh.Client
-	listener      net.Listener
-	udpListener   net.Listener
-	session       *ssh.Session
-	debugListener net.Listener
-	udpChannel    bool
-	tcpChannel    bool
-	closed        bool
+	conf        *Config
+	listener    net.Listener
+	udpListener net.Listener
+	udpChannel  bool
+	tcpChannel  bool
+	closed      bool
+
+	// mu guards the connection specific state below. It is replaced
+	// every time the tunnel gets re-established.
+	mu           sync.Mutex
+	tunnel       *sshTunnel
+	session      *ssh.Session
+	generation   int
+	shuttingDown bool
+	debuggers    map[*WebDebugger]struct{}
+
+	// reconnectMu serializes reconnections, which give up once
+	// reconnectCtx is done. reconnectErr is set for good once a
+	// reconnection gave up.
+	reconnectMu   sync.Mutex
+	reconnectCtx  context.Context
+	stopReconnect context.CancelFunc
+	reconnectErr  error
+
+	// ctx is cancelled when the listener gets closed or when the context
+	// passed to ConnectContext is done.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	parentCtx context.Context
+	closeOnce sync.Once
+	closeErr  error
 
 	tcpDialer tunnel.TcpDialer
 	udpDialer tunnel.UdpDialer
 
 	udpHandler *packetForwardingHandler
+	control    *control.Client
+	inspector  *inspector.Inspector
+
+	urlsMu   sync.Mutex
+	lastUrls []string
+
+	// tracker holds the connections handed out by Accept or served by
+	// ServeHttp, udpTracker the udp sessions of ReadFrom and WriteTo, so
+	// that Shutdown can drain them.
+	tracker      *tunnel.ConnTracker
+	udpTracker   *tunnel.ConnTracker
+	httpServer   *http.Server
+	tcpTunnelMan tunnel.TunnelManager
+	udpTunnelMan tunnel.TunnelManager
+
+	// shaper limits the bandwidth of every connection of the tunnel.
+	shaper *tunnel.BandwidthShaper
 }
 
 type udpListenerWrapper struct {
@@ -54,49 +96,21 @@ func (ul *udpListenerWrapper) Addr() net.Addr {
 // func (pl *pinggyListener) isSocks() bool { return pl.udpChannel && pl.tcpChannel }
 
 func (pl *pinggyListener) getConnectionUrl() []string {
-	logger := pl.conf.Logger
-
-	conn, err := pl.clientConn.Dial("tcp", "localhost:4300")
+	urls, err := pl.control.Urls(pl.ctx)
 	if err != nil {
-		logger.Println("Error connecting the server:", err)
+		pl.conf.log.Error("could not fetch the remote urls", "err", err)
 		return nil
 	}
+	pl.conf.log.Debug("remote urls", "urls", urls)
 
-	req, err := http.NewRequest("GET", "http://localhost:4300/urls", nil)
-	if err != nil {
-		logger.Println("Error creating request:", err)
-		return nil
+	pl.urlsMu.Lock()
+	changed := !equalStrings(pl.lastUrls, urls)
+	pl.lastUrls = urls
+	pl.urlsMu.Unlock()
+	if changed {
+		pl.conf.events.Publish(events.Event{Type: events.UrlsAssigned, Urls: urls})
 	}
-	err = req.Write(conn)
-	if err != nil {
-		logger.Println("Error sending request:", err)
-		return nil
-	}
-
-	// Read the HTTP response
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
-	if err != nil {
-		logger.Println("Error reading response:", err)
-		return nil
-	}
-	defer resp.Body.Close()
-
-	// Print the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logger.Println("Error reading body:", err)
-		return nil
-	}
-
-	urls := make(map[string][]string)
-	err = json.Unmarshal(body, &urls)
-
-	if err != nil {
-		logger.Println("Error parsing body:", err)
-		return nil
-	}
-	logger.Println(urls)
-	return urls["urls"]
+	return urls
 }
 func (pl *pinggyListener) Accept() (net.Conn, error) {
 	if pl.udpHandler != nil {
@@ -107,21 +121,132 @@ func (pl *pinggyListener) Accept() (net.Conn, error) {
 		return nil, fmt.Errorf("automatic tcp forwarding enabled")
 	}
 
-	return pl.listener.Accept()
+	conn, err := pl.listener.Accept()
+	if err != nil {
+		if pl.parentCtx.Err() != nil {
+			return nil, pl.parentCtx.Err()
+		}
+		var rerr *ReconnectError
+		if errors.As(err, &rerr) {
+			return nil, err
+		}
+		if kerr := pl.keepAliveErr(); kerr != nil {
+			return nil, kerr
+		}
+		return nil, err
+	}
+	return pl.shaper.Conn(pl.tracker.Track(conn)), nil
+}
+
+func (pl *pinggyListener) keepAliveErr() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.tunnel.keepAliveErr()
+}
+
+func (pl *pinggyListener) RoundTripTime() time.Duration {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.tunnel.roundTripTime()
 }
 
 func (pl *pinggyListener) Close() error {
-	err := pl.listener.Close()
-	if pl.debugListener != nil {
-		pl.debugListener.Close()
-		pl.debugListener = nil
+	pl.cancel()
+	pl.closeOnce.Do(func() {
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
+		pl.closeErr = pl.tunnel.listener.Close()
+		for wd := range pl.debuggers {
+			// WebDebugger.Close takes pl.mu as well.
+			go wd.Close()
+		}
+		if closer, ok := pl.tcpDialer.(io.Closer); ok {
+			// Stops the health checks of the load balancer.
+			closer.Close()
+		}
+		pl.stopManagers()
+		if pl.session != nil {
+			pl.session.Close()
+			pl.session = nil
+		}
+		pl.tunnel.clientConn.Close()
+		// Let the disconnection get published before closing the bus.
+		<-pl.tunnel.done
+		pl.conf.events.Close()
+	})
+	return pl.closeErr
+}
+
+func (pl *pinggyListener) Shutdown(ctx context.Context) (int, error) {
+	pl.mu.Lock()
+	pl.shuttingDown = true
+	// Give up a reconnection in progress.
+	pl.stopReconnect()
+	// Closing the ssh listener cancels the remote forwarding, channels which
+	// are already open keep working.
+	pl.tunnel.listener.Close()
+	server := pl.httpServer
+	managers := []tunnel.TunnelManager{}
+	if pl.tcpTunnelMan != nil {
+		managers = append(managers, pl.tcpTunnelMan)
+	}
+	if pl.udpTunnelMan != nil {
+		managers = append(managers, pl.udpTunnelMan)
+	}
+	pl.stopManagers()
+	pl.mu.Unlock()
+
+	pl.conf.log.Info("shutting down, waiting for active connections")
+
+	var err error
+	if server != nil {
+		// Shutdown closes idle connections, busy ones are force closed
+		// by draining the tracker below.
+		err = server.Shutdown(ctx)
+	}
+
+	forceClosed, derr := pl.tracker.Drain(ctx)
+	if err == nil {
+		err = derr
+	}
+	n, derr := pl.udpTracker.Drain(ctx)
+	forceClosed += n
+	if err == nil {
+		err = derr
+	}
+	for _, manager := range managers {
+		drainer, ok := manager.(tunnel.Drainer)
+		if !ok {
+			continue
+		}
+		n, derr := drainer.Drain(ctx)
+		forceClosed += n
+		if err == nil {
+			err = derr
+		}
 	}
-	if pl.session != nil {
-		pl.session.Close()
-		pl.session = nil
+	if forceClosed > 0 {
+		pl.conf.log.Warn("connections were force closed", "count", forceClosed)
 	}
-	pl.clientConn.Close()
-	return err
+
+	pl.Close()
+	return forceClosed, err
+}
+
+/*
+stopManagers releases the accept loops of the managers, which may wait for a
+free slot without accepting. pl.mu must be held.
+*/
+func (pl *pinggyListener) stopManagers() {
+	for _, manager := range []tunnel.TunnelManager{pl.tcpTunnelMan, pl.udpTunnelMan} {
+		if stopper, ok := manager.(tunnel.Stopper); ok {
+			stopper.Stop()
+		}
+	}
+}
+
+func (pl *pinggyListener) isClosed() bool {
+	return pl.ctx.Err() != nil
 }
 
 func (pl *pinggyListener) Addr() net.Addr { return pl.listener.Addr() }
@@ -134,55 +259,20 @@ func (pl *pinggyListener) RemoteUrls() []string {
 	return urls
 }
 
-func (pl *pinggyListener) InitiateWebDebug(addr string) error {
-	if pl.conf.Type != HTTP {
-		return fmt.Errorf("webDebugging is available only with %v mode", HTTP)
-	}
-	if pl.session == nil {
-		err := pl.initiateSession()
-		if err != nil {
-			return err
-		}
-		err = pl.session.Shell()
-		if err != nil {
-			pl.conf.Logger.Println("Cannot initiate WebDebug")
-			return err
-		}
-	}
-	if pl.debugListener != nil {
-		return fmt.Errorf("webDebugging is already running at %v", pl.debugListener.Addr().String())
-	}
-	webListener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-	go func() {
-		for {
-			conn, err := webListener.Accept()
-			if err != nil {
-				pl.conf.Logger.Println(err)
-				return
-			}
-			conn2, err := pl.clientConn.Dial("tcp", "localhost:4300")
-			if err != nil {
-				conn.Close()
-				pl.conf.Logger.Println(err)
-				return
-			}
-			go io.Copy(conn, conn2)
-			go io.Copy(conn2, conn)
-		}
-	}()
-	pl.debugListener = webListener
-	return nil
-}
-
 func (pl *pinggyListener) ServeHttp(fs fs.FS) error {
 	httpfs := http.FS(fs)
 
-	server := http.Server{}
+	server := &http.Server{}
 	server.Handler = http.FileServer(httpfs)
-	return server.Serve(pl.listener)
+
+	pl.mu.Lock()
+	if pl.shuttingDown {
+		pl.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	pl.httpServer = server
+	pl.mu.Unlock()
+	return server.Serve(pl.shaper.Listener(pl.tracker.Listener(pl.listener)))
 }
 
 // net.PacketConn
@@ -196,6 +286,9 @@ func (pl *pinggyListener) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	pkt := <-pl.udpHandler.readChannel
 	if pkt.closed {
 		pl.closed = true
+		if kerr := pl.keepAliveErr(); kerr != nil {
+			return 0, nil, kerr
+		}
 		return 0, nil, io.EOF
 	}
 	l := copy(p, pkt.bytes)
@@ -264,31 +357,83 @@ func (pl *pinggyListener) UpdateUdpForwarding(addr string) error {
 	return nil
 }
 
-func (pl *pinggyListener) initiateSession() error {
+func (pl *pinggyListener) UpdateHeaderManipulationAndAuth(hman *HttpHeaderManipulationAndAuthConfig) error {
+	if pl.conf.Type != HTTP {
+		return fmt.Errorf("header manipulation is available only with %v mode", HTTP)
+	}
+	if hman == nil {
+		hman = &HttpHeaderManipulationAndAuthConfig{}
+	}
+	cerr := &ConfigError{}
+	verifyHeaderManipulation(cerr, "HeaderManipulationAndAuth", hman)
+	if err := cerr.errOrNil(); err != nil {
+		return err
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.isClosed() {
+		return net.ErrClosed
+	}
+	err := pl.startShell(pl.tunnel)
+	if err != nil {
+		return err
+	}
+	err = pl.tunnel.control.SetHeaderManipulation(pl.ctx, hman)
+	if err != nil {
+		pl.conf.log.Error("failed to update header manipulation config", "err", err)
+		return err
+	}
+	pl.conf.log.Info("header manipulation config updated")
+
+	// Replayed when the tunnel gets re-established.
+	pl.conf.HeaderManipulationAndAuth = hman
+	pl.conf.startSession = true
+	return nil
+}
+
+/*
+initiateSession, startShell and startSession open the session on tun, which
+is pl.tunnel unless a new tunnel is being set up. They expect pl.mu to be held.
+*/
+func (pl *pinggyListener) initiateSession(tun *sshTunnel) error {
 	if pl.session != nil {
 		return nil
 	}
-	session, err := pl.clientConn.NewSession()
+	session, err := tun.clientConn.NewSession()
 	if err != nil {
-		pl.conf.Logger.Println("Cannot initiate WebDebug")
+		pl.conf.log.Error("cannot initiate session", "err", err)
 		return err
 	}
 
-	session.Stdout = pl.conf.Stdout
-	session.Stderr = pl.conf.Stderr
+	session.Stdout = newServerOutputWriter(pl.conf.Stdout, "stdout", pl.conf.events, pl.conf.log)
+	session.Stderr = newServerOutputWriter(pl.conf.Stderr, "stderr", pl.conf.events, pl.conf.log)
 
 	pl.session = session
 
 	return nil
 }
 
-func (pl *pinggyListener) startSession() error {
-	command := ""
-	for _, ip := range pl.conf.IpWhiteList {
-		command += " w:" + ip.String()
+func (pl *pinggyListener) startShell(tun *sshTunnel) error {
+	if pl.session != nil {
+		return nil
+	}
+	err := pl.initiateSession(tun)
+	if err != nil {
+		return err
+	}
+	err = pl.session.Shell()
+	if err != nil {
+		pl.conf.log.Error("cannot initiate session", "err", err)
+		return err
 	}
+	return nil
+}
+
+func (pl *pinggyListener) startSession(tun *sshTunnel) error {
+	command := whiteListCommand(pl.conf.IpWhiteList)
 
-	err := pl.initiateSession()
+	err := pl.initiateSession(tun)
 	if err != nil {
 		return err
 	}
@@ -298,151 +443,383 @@ func (pl *pinggyListener) startSession() error {
 		err = pl.session.Start(command)
 	}
 	if err != nil {
-		pl.conf.Logger.Println("Cannot initiate WebDebug")
+		pl.conf.log.Error("cannot initiate session", "err", err)
 		return err
 	}
 
 	if pl.conf.HeaderManipulationAndAuth != nil {
-		jsonBytes, err := json.Marshal(pl.conf.HeaderManipulationAndAuth)
-		if err != nil {
-			pl.conf.Logger.Printf("Failed to marshal JSON data: %v\n", err)
-			return err
-		}
-		request, err := http.NewRequest("PUT", "http://localhost:4300/headerman", bytes.NewBuffer(jsonBytes))
+		err = tun.control.SetHeaderManipulation(pl.ctx, pl.conf.HeaderManipulationAndAuth)
 		if err != nil {
-			pl.conf.Logger.Printf("Failed to create HTTP request: %v\n", err)
+			pl.conf.log.Error("failed to apply header manipulation config", "err", err)
 			return err
 		}
-		request.Header.Set("Content-Type", "application/json")
+		pl.conf.log.Info("header manipulation config applied")
+	}
+	return nil
+}
 
-		conn, err := pl.Dial()
-		if err != nil {
-			pl.conf.Logger.Println(err)
-			return err
-		}
+// sshTunnel holds everything that belongs to a single ssh connection.
+type sshTunnel struct {
+	clientConn  *ssh.Client
+	listener    net.Listener
+	udpListener net.Listener
 
-		defer conn.Close()
+	// control dials through this very connection. Unlike the client of
+	// pinggyListener, it can be used while pl.mu is held.
+	control *control.Client
 
-		err = request.Write(conn)
-		if err != nil {
-			return fmt.Errorf("failed to write HTTP request to connection: %v", err)
-		}
-		response, err := http.ReadResponse(bufio.NewReader(conn), request)
-		if err != nil {
-			pl.conf.Logger.Printf("Failed to read HTTP response: %v\n", err)
-			return err
-		}
-		defer response.Body.Close()
+	// done is closed once the ssh connection is gone.
+	done chan struct{}
 
-		// Print the HTTP response
-		pl.conf.Logger.Printf("HTTP Status Code: %d\n", response.StatusCode)
-	}
-	return nil
+	mu  sync.Mutex
+	rtt time.Duration
+	err error
 }
 
-func setupPinggyTunnel(conf Config) (list *pinggyListener, err error) {
-	clientConn, err := dialWithConfig(&conf)
+func (tun *sshTunnel) close() {
+	// Cancelling the forwarding waits for the server to answer, which a dead
+	// server never does. Closing the connection first fails it right away.
+	tun.clientConn.Close()
+	tun.listener.Close()
+}
+
+func openSshTunnel(ctx context.Context, conf *Config) (*sshTunnel, error) {
+	clientConn, err := dialWithConfig(ctx, conf)
 	if err != nil {
-		conf.Logger.Printf("Error in ssh connection initiation: %v\n", err)
-		return
+		conf.log.Error("error in ssh connection initiation", "err", err)
+		return nil, err
 	}
 
-	conf.Logger.Println("Ssh connection initiated. Setting up reverse tunnel")
+	conf.log.Info("ssh connection initiated, setting up reverse tunnel")
+	stop := closeOnCancel(ctx, clientConn)
 	listener, err := clientConn.Listen("tcp", "0.0.0.0:0")
+	if stop() {
+		clientConn.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		clientConn.Close()
-		conf.Logger.Printf("Error in ssh tunnel initiation: %v\n", err)
-		return
+		conf.log.Error("error in ssh tunnel initiation", "err", err)
+		return nil, err
 	}
 
 	var udpListener net.Listener = listener
 
 	if conf.Type != "" && conf.AltType != "" {
 		socksListener := socks.InitiatateSocks5u(listener)
+		socksListener.SetLogger(conf.log)
 		udpListener = &udpListenerWrapper{udpListener: socksListener}
 		listener = socksListener
 		go socksListener.Start()
 	}
 
+	tun := &sshTunnel{clientConn: clientConn, listener: listener, udpListener: udpListener, done: make(chan struct{})}
+	tun.control = control.NewClient(func() (net.Conn, error) {
+		return clientConn.Dial("tcp", control.Addr)
+	})
+	conf.events.Publish(events.Event{Type: events.Connected, Server: conf.serverAddr()})
+	go func() {
+		err := clientConn.Wait()
+		if errors.Is(err, net.ErrClosed) {
+			// Closed on our side.
+			err = nil
+		}
+		if kerr := tun.keepAliveErr(); kerr != nil {
+			err = kerr
+		}
+		conf.events.Publish(events.Event{Type: events.Disconnected, Server: conf.serverAddr(), Err: err})
+		close(tun.done)
+	}()
+	if conf.KeepAliveInterval > 0 {
+		go tun.keepAlive(conf)
+	}
+	return tun, nil
+}
+
+func setupPinggyTunnel(ctx context.Context, conf Config) (list *pinggyListener, err error) {
+	conf.events = events.NewBus()
+	if conf.OnEvent != nil {
+		conf.events.Subscribe(conf.OnEvent)
+	}
+	tun, err := openSshTunnel(ctx, &conf)
+	if err != nil {
+		conf.events.Close()
+		return
+	}
+
 	list = &pinggyListener{
-		listener:    listener,
-		udpListener: udpListener,
-		clientConn:  clientConn,
+		listener:    tun.listener,
+		udpListener: tun.udpListener,
+		tunnel:      tun,
 		conf:        &conf,
 		tcpChannel:  conf.Type != "",
 		udpChannel:  conf.AltType != "",
 		closed:      false,
+		parentCtx:   ctx,
+		tracker:     tunnel.NewConnTracker(),
+		udpTracker:  tunnel.NewConnTracker(),
+		debuggers:   make(map[*WebDebugger]struct{}),
+		shaper:      tunnel.NewBandwidthShaper(tunnel.BandwidthLimits{}),
 
 		tcpDialer: nil,
 		udpDialer: nil,
 	}
 
+	list.ctx, list.cancel = context.WithCancel(ctx)
+	list.reconnectCtx, list.stopReconnect = context.WithCancel(list.ctx)
+	list.control = control.NewClient(list.Dial)
+	if conf.Bandwidth != nil {
+		list.shaper.SetLimits(*conf.Bandwidth)
+	}
+	list.tracker.SetHooks(func(conn net.Conn) {
+		conf.events.Publish(events.Event{Type: events.VisitorOpened, RemoteAddr: conn.RemoteAddr()})
+	}, func(conn net.Conn, stats tunnel.ConnStats) {
+		conf.events.Publish(events.Event{
+			Type:       events.VisitorClosed,
+			RemoteAddr: conn.RemoteAddr(),
+			BytesIn:    stats.BytesIn,
+			BytesOut:   stats.BytesOut,
+			Duration:   stats.Duration,
+		})
+	})
+	list.udpTracker.SetHooks(func(conn net.Conn) {
+		conf.events.Publish(events.Event{Type: events.UdpSessionCreated, RemoteAddr: conn.RemoteAddr()})
+	}, func(conn net.Conn, stats tunnel.ConnStats) {
+		conf.events.Publish(events.Event{
+			Type:       events.UdpSessionExpired,
+			RemoteAddr: conn.RemoteAddr(),
+			BytesIn:    stats.BytesIn,
+			BytesOut:   stats.BytesOut,
+			Duration:   stats.Duration,
+		})
+	})
+
+	if conf.Reconnect != nil {
+		list.listener = &reconnectingListener{pl: list}
+		list.udpListener = &reconnectingListener{pl: list, udp: true}
+	}
+
+	if conf.Inspector != nil {
+		list.inspector = inspector.New(*conf.Inspector)
+		list.listener = list.inspector.Listener(list.listener)
+	}
+
+	if conf.TlsTermination != nil {
+		var terminator *tlsTerminator
+		terminator, err = newTlsTerminator(conf.TlsTermination, list.tunnelHost)
+		if err != nil {
+			list.Close()
+			return
+		}
+		list.listener = terminator.listener(list.listener)
+	}
+
 	if conf.TcpForwardingAddr != "" {
 		var addr *net.TCPAddr = nil
 		addr, err = net.ResolveTCPAddr("tcp", conf.TcpForwardingAddr)
 		if err != nil {
-			list.clientConn.Close()
+			list.Close()
 			return
 		}
 		list.tcpDialer = tunnel.NewTcpDialer(addr)
 	}
 
+	if conf.TcpLoadBalancer != nil {
+		list.tcpDialer, err = tunnel.NewBalancedTcpDialer(*conf.TcpLoadBalancer)
+		if err != nil {
+			list.Close()
+			return
+		}
+	}
+
+	if conf.TcpProxyProtocol != 0 && list.tcpDialer != nil {
+		list.tcpDialer = tunnel.NewProxyHeaderDialer(list.tcpDialer, conf.TcpProxyProtocol)
+	}
+
 	if conf.UdpForwardingAddr != "" {
 		var addr *net.UDPAddr = nil
 		addr, err = net.ResolveUDPAddr("udp", conf.UdpForwardingAddr)
 		if err != nil {
-			list.clientConn.Close()
+			// Stops the health checks of the load balancer as well.
+			list.Close()
 			return
 		}
 		list.udpDialer = tunnel.NewUdpDialer(addr)
 	}
 
+	if list.inspector != nil && list.tcpDialer != nil {
+		// Recorded requests are replayed to the current forwarding address.
+		list.inspector.SetDefaultTarget(func() string {
+			return list.tcpDialer.GetAddr().String()
+		})
+	}
+
+	// Subscribers get the messages printed on the session.
+	if conf.startSession || conf.events.HasSubscribers() {
+		list.mu.Lock()
+		stop := closeOnCancel(ctx, tun.clientConn)
+		if conf.startSession {
+			err = list.startSession(tun)
+		} else {
+			err = list.startShell(tun)
+		}
+		if stop() {
+			err = ctx.Err()
+		}
+		list.mu.Unlock()
+		if err != nil {
+			list.Close()
+			return
+		}
+	}
+
+	go func() {
+		<-list.ctx.Done()
+		list.Close()
+	}()
+
 	if list.udpChannel && list.udpDialer == nil {
 		list.udpHandler = &packetForwardingHandler{
 			list:        list.udpListener,
 			readChannel: make(chan *packet, 50),
 			tunnels:     make(map[string]udpTunnel),
+			logger:      conf.log,
+			tracker:     list.udpTracker,
+			shaper:      list.shaper,
 		}
 		go list.udpHandler.startForwarding()
 	}
 
-	if conf.startSession {
-		err = list.startSession()
-		return
+	// The tunnel hostname names self-signed certificates.
+	if conf.events.HasSubscribers() || conf.TlsTermination != nil {
+		go list.getConnectionUrl()
 	}
 
 	return
 }
 
+/*
+configureManager passes the logger, event bus, limits and bandwidth shaper of
+the listener on to manager, as far as it supports them.
+*/
+func (pl *pinggyListener) configureManager(manager tunnel.TunnelManager) {
+	manager.SetLogger(pl.conf.log)
+	if setter, ok := manager.(tunnel.EventBusSetter); ok {
+		setter.SetEventBus(pl.conf.events)
+	}
+	if setter, ok := manager.(tunnel.LimitsSetter); ok && pl.conf.ForwardingLimits != nil {
+		setter.SetLimits(*pl.conf.ForwardingLimits)
+	}
+	if setter, ok := manager.(tunnel.BandwidthShaperSetter); ok {
+		setter.SetBandwidthShaper(pl.shaper)
+	}
+}
+
 func (pl *pinggyListener) StartForwarding() error {
 	var wg sync.WaitGroup
-	forwarding := false
+	managers := []tunnel.TunnelManager{}
 	//add socks here
+	pl.mu.Lock()
+	if pl.shuttingDown {
+		pl.mu.Unlock()
+		return net.ErrClosed
+	}
 	if pl.udpChannel && pl.udpDialer != nil {
-		forwarding = true
-		wg.Add(1)
-		go func(pl *pinggyListener, wg *sync.WaitGroup) {
-			defer wg.Done()
-			udpTunnelMan := tunnel.NewUdpTunnelMangerWithDialer(pl.udpListener, pl.udpDialer)
-			udpTunnelMan.StartForwarding()
-		}(pl, &wg)
+		pl.udpTunnelMan = tunnel.NewUdpTunnelMangerWithDialer(pl.udpListener, pl.udpDialer)
+		pl.configureManager(pl.udpTunnelMan)
+		managers = append(managers, pl.udpTunnelMan)
 	}
 	if pl.tcpChannel && pl.tcpDialer != nil {
-		forwarding = true
-		wg.Add(1)
-		go func(pl *pinggyListener, wg *sync.WaitGroup) {
-			defer wg.Done()
-			tcpTunnelMan := tunnel.NewTcpTunnelMangerDialer(pl.listener, pl.tcpDialer)
-			tcpTunnelMan.StartForwarding()
-		}(pl, &wg)
+		pl.tcpTunnelMan = tunnel.NewTcpTunnelMangerDialer(pl.listener, pl.tcpDialer)
+		pl.configureManager(pl.tcpTunnelMan)
+		managers = append(managers, pl.tcpTunnelMan)
 	}
-	if !forwarding {
+	pl.mu.Unlock()
+	if len(managers) == 0 {
 		return fmt.Errorf("nothing to forward")
 	}
+	for _, manager := range managers {
+		wg.Add(1)
+		go func(manager tunnel.TunnelManager, wg *sync.WaitGroup) {
+			defer wg.Done()
+			manager.StartForwarding()
+		}(manager, &wg)
+	}
 	wg.Wait()
-	return nil
+	return pl.keepAliveErr()
 }
 
 func (pl *pinggyListener) Dial() (net.Conn, error) {
-	return pl.clientConn.Dial("tcp", "localhost:4300")
+	pl.mu.Lock()
+	clientConn := pl.tunnel.clientConn
+	pl.mu.Unlock()
+	return clientConn.Dial("tcp", control.Addr)
+}
+
+func (pl *pinggyListener) Control() *control.Client {
+	return pl.control
+}
+
+func (pl *pinggyListener) Subscribe(handler events.Handler) (unsubscribe func()) {
+	unsubscribe = pl.conf.events.Subscribe(handler)
+
+	// The server prints its messages on the session only.
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if !pl.isClosed() && pl.session == nil {
+		if err := pl.startShell(pl.tunnel); err != nil {
+			pl.conf.log.Warn("cannot open a session for the server messages", "err", err)
+		}
+	}
+	return unsubscribe
+}
+
+func (pl *pinggyListener) SetBandwidthLimits(limits tunnel.BandwidthLimits) error {
+	if err := limits.Verify(); err != nil {
+		return err
+	}
+	pl.shaper.SetLimits(limits)
+	return nil
+}
+
+func (pl *pinggyListener) BandwidthLimits() tunnel.BandwidthLimits {
+	return pl.shaper.Limits()
+}
+
+func (pl *pinggyListener) Stats() tunnel.ForwardingStats {
+	pl.mu.Lock()
+	managers := []tunnel.TunnelManager{pl.tcpTunnelMan, pl.udpTunnelMan}
+	pl.mu.Unlock()
+
+	stats := tunnel.ForwardingStats{}
+	for _, manager := range managers {
+		if manager != nil {
+			stats.Add(manager.Stats())
+		}
+	}
+	return stats
+}
+
+func (pl *pinggyListener) Inspector() *inspector.Inspector {
+	return pl.inspector
+}
+
+func (pl *pinggyListener) SubscribeServerMessages(handler func(servermsg.Message)) (unsubscribe func()) {
+	return pl.Subscribe(func(event events.Event) {
+		if event.Type == events.ServerMessage && event.Parsed != nil {
+			handler(*event.Parsed)
+		}
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
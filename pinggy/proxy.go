@@ -0,0 +1,302 @@
+package pinggy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/socks"
+)
+
+/*
+proxyForServer returns the upstream proxy to use for reaching addr, or nil if
+the server has to be dialed directly.
+*/
+func proxyForServer(conf *Config, addr string) (*url.URL, error) {
+	rawUrl := conf.Proxy
+	if rawUrl == "" && conf.ProxyFromEnvironment {
+		if bypassProxy(getEnvAny("NO_PROXY", "no_proxy"), addr) {
+			return nil, nil
+		}
+		rawUrl = getEnvAny("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+	}
+	if rawUrl == "" {
+		return nil, nil
+	}
+	return parseProxyUrl(rawUrl)
+}
+
+func parseProxyUrl(rawUrl string) (*url.URL, error) {
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "http://" + rawUrl
+	}
+	proxyUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyUrl.Scheme)
+	}
+	if proxyUrl.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy url: missing host")
+	}
+	return proxyUrl, nil
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if val := os.Getenv(name); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+/*
+bypassProxy reports whether addr matches the NO_PROXY list. Entries can be host
+names (matching sub domains as well), ip addresses, CIDRs, optionally followed
+by a port, or `*` to disable proxying altogether.
+*/
+func bypassProxy(noProxy string, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		entry = strings.Trim(entry, "[]")
+		if entryIp := net.ParseIP(entry); entryIp != nil {
+			if ip != nil && entryIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+connectThroughProxy asks the proxy at the other end of conn to open a
+connection to addr. The returned connection must be used instead of conn.
+*/
+func connectThroughProxy(ctx context.Context, conn net.Conn, proxyUrl *url.URL, addr string) (net.Conn, error) {
+	switch proxyUrl.Scheme {
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+		err := tlsConn.Handshake()
+		if err != nil {
+			return nil, err
+		}
+		return httpConnect(tlsConn, proxyUrl, addr)
+	case "http":
+		return httpConnect(conn, proxyUrl, addr)
+	default:
+		return conn, socks5Connect(ctx, conn, proxyUrl, addr)
+	}
+}
+
+func proxyAddr(proxyUrl *url.URL) string {
+	port := proxyUrl.Port()
+	if port == "" {
+		switch proxyUrl.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(proxyUrl.Hostname(), port)
+}
+
+// bufferedConn returns the data already buffered by a reader before reading from the conn.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func httpConnect(conn net.Conn, proxyUrl *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := proxyUrl.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+
+	// The server may start talking before we do.
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+func socks5Connect(ctx context.Context, conn net.Conn, proxyUrl *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{0}
+	if proxyUrl.User != nil {
+		methods = []byte{0, 2}
+	}
+	_, err = conn.Write(append([]byte{5, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case 0:
+	case 2:
+		if proxyUrl.User == nil {
+			return fmt.Errorf("socks proxy requires authentication")
+		}
+		username := proxyUrl.User.Username()
+		password, _ := proxyUrl.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("socks credentials too long")
+		}
+		msg := []byte{1, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		_, err = conn.Write(msg)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("socks proxy authentication failed")
+		}
+	default:
+		return fmt.Errorf("no acceptable socks authentication method")
+	}
+
+	request := []byte{5, byte(socks.SocksCmd_Connect), 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxyUrl.Scheme == "socks5" {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0].IP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else if ip != nil {
+		request = append(append(request, 4), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("socks proxy refused connection to %s: code %d", addr, header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		_, err = io.ReadFull(conn, header[:1])
+		if err != nil {
+			return err
+		}
+		skip = int(header[0])
+	default:
+		return fmt.Errorf("unsupported socks address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
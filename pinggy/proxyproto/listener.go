@@ -0,0 +1,123 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+DefaultHeaderTimeout is the time given to a connection of NewConn to send its
+header.
+*/
+const DefaultHeaderTimeout = 5 * time.Second
+
+/*
+Conn reads the PROXY protocol header of a connection on first use of Read or
+Header. RemoteAddr and LocalAddr then report the addresses of the header;
+they never wait for it and report the addresses of the connection until then.
+
+A connection whose data does not start with a header is passed through as
+is, Header returning ErrNoHeader. A connection sending neither data nor a
+valid header within the timeout is closed.
+*/
+type Conn struct {
+	net.Conn
+
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	// Closed once the header is read.
+	done   chan struct{}
+	header *Header
+	err    error
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return NewConnTimeout(conn, DefaultHeaderTimeout)
+}
+
+/*
+NewConnTimeout is NewConn with a timeout for reading the header, none if
+zero. The read deadline of conn is reset after the header.
+*/
+func NewConnTimeout(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout, done: make(chan struct{})}
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		defer close(c.done)
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.header, c.err = Read(c.reader)
+		if c.err != nil && c.err != ErrNoHeader {
+			c.Conn.Close()
+		}
+	})
+}
+
+/*
+parsedHeader returns the header if it has been read already.
+*/
+func (c *Conn) parsedHeader() *Header {
+	select {
+	case <-c.done:
+		return c.header
+	default:
+		return nil
+	}
+}
+
+/*
+Header returns the header of the connection, reading it if needed.
+*/
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil && c.err != ErrNoHeader {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if header := c.parsedHeader(); header != nil && header.Source != nil {
+		return header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if header := c.parsedHeader(); header != nil && header.Destination != nil {
+		return header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+/*
+NewListener wraps l so that accepted connections are *Conn. The header is
+read on the first Read or Header of a connection, not by Accept.
+*/
+func NewListener(l net.Listener) net.Listener {
+	return &listener{Listener: l}
+}
@@ -0,0 +1,266 @@
+/*
+Package proxyproto writes and parses PROXY protocol headers, versions 1 and 2,
+which carry the address of the original client to a backend.
+*/
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type Version int
+
+const (
+	V1 Version = 1
+	V2 Version = 2
+)
+
+/*
+ErrNoHeader is returned when the data does not start with a PROXY protocol header.
+*/
+var ErrNoHeader = errors.New("no proxy protocol header")
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1MaxLength = 107
+
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamilyUnspec = 0x00
+	v2FamilyTcp4   = 0x11
+	v2FamilyTcp6   = 0x21
+)
+
+type Header struct {
+	Version Version
+
+	/*
+		Addresses of the original connection, the client being Source. Both are
+		nil if the connection was not proxied or the addresses are unknown.
+	*/
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+/*
+NewHeader builds a header for a connection from src to dst. Addresses other
+than *net.TCPAddr make the header carry no address. A missing or unusable
+dst is replaced by the unspecified address of the family of src.
+*/
+func NewHeader(version Version, src, dst net.Addr) *Header {
+	h := &Header{Version: version}
+	source, ok := src.(*net.TCPAddr)
+	if !ok || source == nil || source.IP == nil {
+		return h
+	}
+	destination, ok := dst.(*net.TCPAddr)
+	if !ok || destination == nil || destination.IP == nil {
+		destination = &net.TCPAddr{IP: net.IPv4zero}
+		if source.IP.To4() == nil {
+			destination.IP = net.IPv6unspecified
+		}
+	}
+	h.Source = source
+	h.Destination = destination
+	return h
+}
+
+func (h *Header) ipv4() bool {
+	return h.Source.IP.To4() != nil && h.Destination.IP.To4() != nil
+}
+
+/*
+Format renders the header, ready to be sent before the proxied data.
+*/
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case V1:
+		return h.formatV1(), nil
+	case V2:
+		return h.formatV2(), nil
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol version %d", h.Version)
+	}
+}
+
+func (h *Header) formatV1() []byte {
+	if h.Source == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family, src, dst := "TCP6", h.Source.IP.To16().String(), h.Destination.IP.To16().String()
+	if h.ipv4() {
+		family, src, dst = "TCP4", h.Source.IP.To4().String(), h.Destination.IP.To4().String()
+	} else {
+		// An ipv4 address would not be printed in its ipv6 form.
+		if h.Source.IP.To4() != nil {
+			src = "::ffff:" + src
+		}
+		if h.Destination.IP.To4() != nil {
+			dst = "::ffff:" + dst
+		}
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src, dst, h.Source.Port, h.Destination.Port))
+}
+
+func (h *Header) formatV2() []byte {
+	var buf bytes.Buffer
+	buf.Write(v2Signature)
+	if h.Source == nil {
+		buf.Write([]byte{v2CmdLocal, v2FamilyUnspec, 0, 0})
+		return buf.Bytes()
+	}
+
+	var addrs []byte
+	family := byte(v2FamilyTcp6)
+	if h.ipv4() {
+		family = v2FamilyTcp4
+		addrs = append(addrs, h.Source.IP.To4()...)
+		addrs = append(addrs, h.Destination.IP.To4()...)
+	} else {
+		addrs = append(addrs, h.Source.IP.To16()...)
+		addrs = append(addrs, h.Destination.IP.To16()...)
+	}
+	addrs = append(addrs, byte(h.Source.Port>>8), byte(h.Source.Port))
+	addrs = append(addrs, byte(h.Destination.Port>>8), byte(h.Destination.Port))
+
+	buf.Write([]byte{v2CmdProxy, family})
+	binary.Write(&buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	return buf.Bytes()
+}
+
+/*
+WriteTo writes the formatted header to w.
+*/
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	data, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+/*
+Read parses a version 1 or 2 header from r, leaving the following data in r.
+ErrNoHeader is returned if r does not start with a header.
+*/
+func Read(r *bufio.Reader) (*Header, error) {
+	// The shortest valid header, `PROXY UNKNOWN\r\n`, is longer than the signature.
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		if bytes.HasPrefix(v2Signature, start) || bytes.HasPrefix([]byte("PROXY "), start) || bytes.HasPrefix(start, []byte("PROXY ")) {
+			return nil, err
+		}
+		return nil, ErrNoHeader
+	}
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, fmt.Errorf("proxy protocol v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("proxy protocol v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: V1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy protocol v1 header %q", line)
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return nil, fmt.Errorf("invalid address %q in proxy protocol v1 header", ip)
+	}
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in proxy protocol v1 header", port)
+	}
+	return &net.TCPAddr{IP: parsedIp, Port: int(parsedPort)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid proxy protocol v2 version %d", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: V2}
+	switch fixed[12] {
+	case v2CmdLocal:
+		return h, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("invalid proxy protocol v2 command %#x", fixed[12]&0xf)
+	}
+
+	ipLen := 0
+	switch fixed[13] {
+	case v2FamilyTcp4:
+		ipLen = net.IPv4len
+	case v2FamilyTcp6:
+		ipLen = net.IPv6len
+	default:
+		// Other families, e.g. udp or unix sockets, carry no tcp address.
+		return h, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("proxy protocol v2 address block too short")
+	}
+	ports := body[2*ipLen:]
+	h.Source = &net.TCPAddr{IP: net.IP(append([]byte{}, body[:ipLen]...)), Port: int(binary.BigEndian.Uint16(ports[0:2]))}
+	h.Destination = &net.TCPAddr{IP: net.IP(append([]byte{}, body[ipLen:2*ipLen]...)), Port: int(binary.BigEndian.Uint16(ports[2:4]))}
+	return h, nil
+}
@@ -0,0 +1,193 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	tests := []struct {
+		version  Version
+		src, dst net.Addr
+		v1       string
+	}{
+		{V1, v4, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n"},
+		{V1, v6, v4, "PROXY TCP6 2001:db8::1 ::ffff:203.0.113.7 443 5555\r\n"},
+		{V1, v4, nil, "PROXY TCP4 203.0.113.7 0.0.0.0 5555 0\r\n"},
+		{V1, &net.UnixAddr{Name: "sock"}, nil, "PROXY UNKNOWN\r\n"},
+		{V2, v4, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, ""},
+		{V2, v6, nil, ""},
+		{V2, nil, nil, ""},
+	}
+	for i, test := range tests {
+		header := NewHeader(test.version, test.src, test.dst)
+		data, err := header.Format()
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if test.v1 != "" && string(data) != test.v1 {
+			t.Errorf("%d: formatted %q, expected %q", i, data, test.v1)
+		}
+
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("payload")))
+		parsed, err := Read(r)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if parsed.Version != test.version || parsed.Source.String() != header.Source.String() ||
+			parsed.Destination.String() != header.Destination.String() {
+			t.Errorf("%d: parsed %+v, expected %+v", i, parsed, header)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%d: payload %q", i, rest)
+		}
+	}
+}
+
+func TestReadNoHeader(t *testing.T) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", "hi"} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(data))); err != ErrNoHeader {
+			t.Errorf("%q: expected ErrNoHeader, got %v", data, err)
+		}
+	}
+	if _, err := Read(bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4\r\n"))); err == nil || err == ErrNoHeader {
+		t.Errorf("expected an invalid header error, got %v", err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = NewListener(l)
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		NewHeader(V2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}, nil).WriteTo(conn)
+		conn.Write([]byte("hello"))
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if data, _ := io.ReadAll(conn); string(data) != "hello" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "203.0.113.7:5555" {
+		t.Errorf("unexpected remote address %v", addr)
+	}
+}
+
+/*
+pipeConn returns a Conn reading from a pipe, and the other end of the pipe.
+*/
+func pipeConn(t *testing.T, timeout time.Duration) (*Conn, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return NewConnTimeout(local, timeout), remote
+}
+
+func TestConnNoHeader(t *testing.T) {
+	conn, remote := pipeConn(t, time.Second)
+	go func() {
+		remote.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		remote.Close()
+	}()
+
+	// The data is passed through.
+	if data, _ := io.ReadAll(conn); string(data) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if _, err := conn.Header(); err != ErrNoHeader {
+		t.Errorf("expected ErrNoHeader, got %v", err)
+	}
+	if conn.RemoteAddr() != conn.Conn.RemoteAddr() {
+		t.Errorf("unexpected remote address %v", conn.RemoteAddr())
+	}
+}
+
+func TestConnShortData(t *testing.T) {
+	// Less data than a header, and the visitor waits for an answer.
+	conn, remote := pipeConn(t, 100*time.Millisecond)
+	go remote.Write([]byte("hi"))
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("unexpected data %q: %v", buf, err)
+	}
+	// The deadline of the header is gone.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		remote.Write([]byte("!"))
+	}()
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil || buf[0] != '!' {
+		t.Fatalf("unexpected data %q: %v", buf[:1], err)
+	}
+}
+
+func TestConnHeaderTimeout(t *testing.T) {
+	conn, remote := pipeConn(t, 100*time.Millisecond)
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || err == ErrNoHeader {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("header read not timed out, took %v", elapsed)
+	}
+	// The connection is closed.
+	if _, err := remote.Write([]byte("late")); err == nil {
+		t.Fatal("connection still open")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after a timeout")
+	}
+}
+
+func TestConnAddrDoesNotBlock(t *testing.T) {
+	conn, remote := pipeConn(t, time.Second)
+
+	// Nothing has been sent, the addresses of the connection are reported.
+	done := make(chan struct{})
+	go func() {
+		conn.RemoteAddr()
+		conn.LocalAddr()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("RemoteAddr waited for the header")
+	}
+
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	go NewHeader(V1, src, dst).WriteTo(remote)
+	if _, err := conn.Header(); err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != src.String() {
+		t.Errorf("unexpected remote address %v", addr)
+	}
+	if addr := conn.LocalAddr().String(); addr != dst.String() {
+		t.Errorf("unexpected local address %v", addr)
+	}
+}
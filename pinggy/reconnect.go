@@ -0,0 +1,205 @@
+package pinggy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/*
+reconnectingListener is handed out instead of the raw ssh listener when
+reconnection is enabled. Whenever the underlying listener fails, it waits for
+the tunnel to be re-established and continues accepting from the new one.
+*/
+type reconnectingListener struct {
+	pl  *pinggyListener
+	udp bool
+
+	// Set atomically, Close may run concurrently with Accept.
+	closed int32
+}
+
+func (rl *reconnectingListener) current() (int, net.Listener) {
+	rl.pl.mu.Lock()
+	defer rl.pl.mu.Unlock()
+	if rl.udp {
+		return rl.pl.generation, rl.pl.tunnel.udpListener
+	}
+	return rl.pl.generation, rl.pl.tunnel.listener
+}
+
+func (rl *reconnectingListener) isClosed() bool {
+	return atomic.LoadInt32(&rl.closed) != 0
+}
+
+func (rl *reconnectingListener) Accept() (net.Conn, error) {
+	for {
+		if rl.isClosed() {
+			return nil, net.ErrClosed
+		}
+		generation, listener := rl.current()
+		conn, err := listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if rl.isClosed() {
+			return nil, err
+		}
+		if rerr := rl.pl.reconnect(generation); rerr != nil {
+			return nil, rerr
+		}
+	}
+}
+
+func (rl *reconnectingListener) Close() error {
+	atomic.StoreInt32(&rl.closed, 1)
+	_, listener := rl.current()
+	return listener.Close()
+}
+
+func (rl *reconnectingListener) Addr() net.Addr {
+	_, listener := rl.current()
+	return listener.Addr()
+}
+
+/*
+ReconnectError is returned by Accept once the reconnection gave up. The
+listener does not try again, every later Accept returns the same error.
+*/
+type ReconnectError struct {
+	/*
+		Number of failed attempts.
+	*/
+	Attempts int
+
+	/*
+		Error of the last attempt.
+	*/
+	Err error
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("could not reconnect after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *ReconnectError) Unwrap() error {
+	return e.Err
+}
+
+/*
+reconnect replaces the tunnel of the given generation with a new one. Callers
+that observed a failure on an older generation return immediately, as someone
+else has already reconnected. Everyone else waits until the tunnel is back or
+the reconnection gives up.
+
+Only one reconnection runs at a time. pl.mu is not held while dialing and
+backing off, so the rest of the listener keeps working on the dead tunnel,
+failing fast. Shutdown and Close abort the reconnection.
+*/
+func (pl *pinggyListener) reconnect(generation int) error {
+	pl.reconnectMu.Lock()
+	defer pl.reconnectMu.Unlock()
+	if pl.reconnectErr != nil {
+		return pl.reconnectErr
+	}
+
+	pl.mu.Lock()
+	if pl.isClosed() || pl.shuttingDown {
+		pl.mu.Unlock()
+		return net.ErrClosed
+	}
+	if pl.generation != generation {
+		pl.mu.Unlock()
+		return nil
+	}
+	hadSession := pl.session != nil
+	if pl.session != nil {
+		pl.session.Close()
+		pl.session = nil
+	}
+	pl.tunnel.close()
+	pl.mu.Unlock()
+
+	ctx := pl.reconnectCtx
+	rc := pl.conf.Reconnect
+	backoff := rc.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		pl.conf.log.Info("reconnecting to the server", "attempt", attempt)
+		err := pl.restoreTunnel(ctx, hadSession)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return net.ErrClosed
+		}
+		pl.conf.log.Warn("reconnection failed", "attempt", attempt, "err", err)
+		if rc.MaxAttempts > 0 && attempt >= rc.MaxAttempts {
+			pl.conf.log.Error("giving up reconnecting", "attempts", attempt)
+			pl.reconnectErr = &ReconnectError{Attempts: attempt, Err: err}
+			return pl.reconnectErr
+		}
+
+		select {
+		case <-ctx.Done():
+			return net.ErrClosed
+		case <-time.After(backoff):
+		}
+		backoff = time.Duration(float64(backoff) * rc.Multiplier)
+		if backoff > rc.MaxBackoff {
+			backoff = rc.MaxBackoff
+		}
+	}
+
+	pl.conf.log.Info("tunnel re-established")
+	if rc.OnReconnect != nil || pl.conf.events.HasSubscribers() {
+		go func() {
+			urls := pl.RemoteUrls()
+			if rc.OnReconnect != nil {
+				rc.OnReconnect(urls)
+			}
+		}()
+	}
+	return nil
+}
+
+/*
+restoreTunnel opens a new ssh connection without holding pl.mu, then restarts
+the session on it under pl.mu. The new tunnel replaces the old one only once
+it is completely set up.
+*/
+func (pl *pinggyListener) restoreTunnel(ctx context.Context, hadSession bool) error {
+	tun, err := openSshTunnel(ctx, pl.conf)
+	if err != nil {
+		return err
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.isClosed() || pl.shuttingDown {
+		tun.close()
+		return net.ErrClosed
+	}
+
+	stop := closeOnCancel(ctx, tun.clientConn)
+	if pl.conf.startSession {
+		err = pl.startSession(tun)
+	} else if hadSession {
+		err = pl.startShell(tun)
+	}
+	if stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		if pl.session != nil {
+			pl.session.Close()
+			pl.session = nil
+		}
+		tun.close()
+		return err
+	}
+	pl.tunnel = tun
+	pl.generation += 1
+	return nil
+}
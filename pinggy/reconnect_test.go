@@ -0,0 +1,161 @@
+package pinggy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func acceptAsync(pl *pinggyListener) <-chan error {
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := pl.Accept()
+		if err == nil {
+			defer conn.Close()
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+		}
+		accepted <- err
+	}()
+	return accepted
+}
+
+func expectAccepted(t *testing.T, accepted <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-accepted:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return")
+		return nil
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newTestServer(t)
+	reconnected := make(chan []string, 1)
+	pl := s.connect(t, Config{Reconnect: &ReconnectConfig{
+		InitialBackoff: 10 * time.Millisecond,
+		OnReconnect: func(urls []string) {
+			reconnected <- urls
+		},
+	}})
+
+	accepted := acceptAsync(pl)
+	s.dropAll()
+	select {
+	case urls := <-reconnected:
+		if len(urls) != 2 || urls[0] != "http://abc.a.pinggy.link" {
+			t.Fatalf("unexpected urls %v", urls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+
+	visitor := s.openVisitor(t)
+	defer visitor.Close()
+	io.WriteString(visitor, "hello")
+	if err := expectAccepted(t, accepted); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{Reconnect: &ReconnectConfig{InitialBackoff: 10 * time.Millisecond, MaxAttempts: 3}})
+	dials := s.dialCount()
+
+	// All callers share the attempts of a single reconnection.
+	first, second := acceptAsync(pl), acceptAsync(pl)
+	s.setDown(true)
+	for _, accepted := range []<-chan error{first, second} {
+		var rerr *ReconnectError
+		if err := expectAccepted(t, accepted); !errors.As(err, &rerr) || rerr.Attempts != 3 {
+			t.Fatalf("expected a ReconnectError after 3 attempts, got %v", err)
+		}
+	}
+	if attempts := s.dialCount() - dials; attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+
+	// Giving up is final.
+	s.setDown(false)
+	var rerr *ReconnectError
+	if _, err := pl.Accept(); !errors.As(err, &rerr) {
+		t.Fatalf("expected a ReconnectError, got %v", err)
+	}
+	if attempts := s.dialCount() - dials; attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestReconnectConcurrentAccept(t *testing.T) {
+	s := newTestServer(t)
+	reconnected := make(chan struct{}, 10)
+	pl := s.connect(t, Config{Reconnect: &ReconnectConfig{
+		InitialBackoff: 10 * time.Millisecond,
+		OnReconnect: func([]string) {
+			reconnected <- struct{}{}
+		},
+	}})
+
+	acceptors := []<-chan error{acceptAsync(pl), acceptAsync(pl), acceptAsync(pl)}
+	s.dropAll()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+
+	for range acceptors {
+		visitor := s.openVisitor(t)
+		defer visitor.Close()
+		io.WriteString(visitor, "hello")
+	}
+	for _, accepted := range acceptors {
+		if err := expectAccepted(t, accepted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A single reconnection served everyone.
+	if n := s.connections(); n != 1 {
+		t.Fatalf("expected a single connection, got %d", n)
+	}
+	select {
+	case <-reconnected:
+		t.Fatal("reconnected twice")
+	default:
+	}
+}
+
+func TestReconnectAbortedByShutdown(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{Reconnect: &ReconnectConfig{InitialBackoff: time.Hour}})
+	accepted := acceptAsync(pl)
+	s.setDown(true)
+	waitFor(t, "a reconnection attempt", func() bool {
+		return s.dialCount() > 1
+	})
+
+	// The listener stays usable while reconnecting.
+	done := make(chan struct{})
+	go func() {
+		pl.Stats()
+		pl.RoundTripTime()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		pl.Shutdown(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked by the reconnection")
+	}
+	if err := expectAccepted(t, accepted); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+}
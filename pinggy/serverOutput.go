@@ -0,0 +1,69 @@
+package pinggy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+	"github.com/Pinggy-io/pinggy-go/pinggy/servermsg"
+)
+
+/*
+serverOutputWriter receives the output of the session. It passes the raw bytes
+on to the configured writer and publishes every complete line as a parsed
+server message.
+*/
+type serverOutputWriter struct {
+	out    io.Writer
+	stream string
+	bus    *events.Bus
+	logger logging.Logger
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func newServerOutputWriter(out io.Writer, stream string, bus *events.Bus, logger logging.Logger) *serverOutputWriter {
+	return &serverOutputWriter{out: out, stream: stream, bus: bus, logger: logger}
+}
+
+func (w *serverOutputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(w.pending[:i], "\r"))
+		w.pending = w.pending[i+1:]
+		if line != "" {
+			w.publish(line)
+		}
+	}
+	w.mu.Unlock()
+
+	if w.out == nil {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
+
+func (w *serverOutputWriter) publish(line string) {
+	msg := servermsg.Parse(line, time.Now())
+	if msg.Text == "" {
+		return
+	}
+	switch msg.Kind {
+	case servermsg.AuthFailure, servermsg.Error:
+		w.logger.Error("server: "+msg.Text, "kind", msg.Kind)
+	case servermsg.RateLimit, servermsg.Warning:
+		w.logger.Warn("server: "+msg.Text, "kind", msg.Kind)
+	default:
+		w.logger.Debug("server: "+msg.Text, "kind", msg.Kind)
+	}
+	w.bus.Publish(events.Event{Type: events.ServerMessage, Message: line, Stream: w.stream, Parsed: &msg})
+}
@@ -0,0 +1,59 @@
+package pinggy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/servermsg"
+)
+
+func TestSubscribeServerMessages(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+
+	messages := make(chan servermsg.Message, 10)
+	unsubscribe := pl.SubscribeServerMessages(func(msg servermsg.Message) {
+		messages <- msg
+	})
+	defer unsubscribe()
+
+	kinds := make(map[servermsg.Kind]servermsg.Message)
+	timeout := time.After(5 * time.Second)
+	for len(kinds) < 3 {
+		select {
+		case msg := <-messages:
+			kinds[msg.Kind] = msg
+		case <-timeout:
+			t.Fatalf("server messages missing, got %v", kinds)
+		}
+	}
+	if msg := kinds[servermsg.Urls]; len(msg.Urls) != 1 || msg.Urls[0] != "http://abc.a.pinggy.link" {
+		t.Fatalf("unexpected urls %v", msg.Urls)
+	}
+	if msg := kinds[servermsg.Expiry]; msg.ExpiresIn != 60*time.Minute {
+		t.Fatalf("unexpected expiry %v", msg.ExpiresIn)
+	}
+	if _, ok := kinds[servermsg.Warning]; !ok {
+		t.Fatal("warning missing")
+	}
+}
+
+func TestServerMessageEvents(t *testing.T) {
+	s := newTestServer(t)
+	received := make(chan events.Event, 20)
+	s.connect(t, Config{OnEvent: func(event events.Event) {
+		if event.Type == events.ServerMessage {
+			received <- event
+		}
+	}})
+
+	select {
+	case event := <-received:
+		if event.Stream != "stdout" || event.Parsed == nil || event.Message == "" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no server message")
+	}
+}
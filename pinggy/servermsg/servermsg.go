@@ -0,0 +1,169 @@
+/*
+Package servermsg classifies the lines the pinggy server prints on the ssh
+session, e.g. the url banner or the expiry notice, into typed messages.
+*/
+package servermsg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Kind int
+
+const (
+	/*
+		Anything not recognized.
+	*/
+	Text Kind = iota
+
+	/*
+		Public urls of the tunnel. Urls is set.
+	*/
+	Urls
+
+	/*
+		When the tunnel expires. ExpiresIn and ExpiresAt are set.
+	*/
+	Expiry
+
+	Warning
+
+	/*
+		The server did not accept the token or the key.
+	*/
+	AuthFailure
+
+	/*
+		The server refuses to serve more tunnels or connections.
+	*/
+	RateLimit
+
+	Error
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Text:
+		return "text"
+	case Urls:
+		return "urls"
+	case Expiry:
+		return "expiry"
+	case Warning:
+		return "warning"
+	case AuthFailure:
+		return "auth_failure"
+	case RateLimit:
+		return "rate_limit"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("kind(%d)", int(k))
+	}
+}
+
+type Message struct {
+	Kind Kind
+
+	/*
+		The line without terminal escape sequences and surrounding spaces.
+	*/
+	Text string
+
+	Urls []string
+
+	ExpiresIn time.Duration
+	ExpiresAt time.Time
+}
+
+var (
+	ansiRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[@-_]`)
+	urlRegexp  = regexp.MustCompile(`^(?:https?|tcp|tls|tlstcp|udp)://[^\s"'<>]+$`)
+	// The notice of the free tunnels: "Your tunnel will expire in 60 minutes. ..."
+	expiryRegexp = regexp.MustCompile(`(?i)^your tunnel will expire in\s+(\d+)\s*(second|sec|minute|min|hour|hr|day)s?\b`)
+)
+
+var expiryUnits = map[string]time.Duration{
+	"second": time.Second,
+	"sec":    time.Second,
+	"minute": time.Minute,
+	"min":    time.Minute,
+	"hour":   time.Hour,
+	"hr":     time.Hour,
+	"day":    24 * time.Hour,
+}
+
+/*
+Beginnings of the lines printed by the server, lower case. Only the start of
+a line is matched, so that urls or free text mentioning these words are not
+taken for them.
+*/
+var (
+	authFailurePrefixes = []string{"authentication failed", "invalid token", "permission denied"}
+	rateLimitPrefixes   = []string{"rate limit", "too many"}
+	errorPrefixes       = []string{"error:", "error "}
+	warningPrefixes     = []string{"you are not authenticated", "warning:", "warning "}
+)
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Parse classifies a single line of output. Expiry times are computed relative
+to now. Urls are recognized on lines holding nothing but urls, as the server
+prints them.
+*/
+func Parse(line string, now time.Time) Message {
+	text := strings.TrimSpace(ansiRegexp.ReplaceAllString(line, ""))
+	msg := Message{Kind: Text, Text: text}
+	lower := strings.ToLower(text)
+
+	if match := expiryRegexp.FindStringSubmatch(text); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err == nil {
+			msg.Kind = Expiry
+			msg.ExpiresIn = time.Duration(count) * expiryUnits[strings.ToLower(match[2])]
+			msg.ExpiresAt = now.Add(msg.ExpiresIn)
+			return msg
+		}
+	}
+
+	switch {
+	case hasAnyPrefix(lower, authFailurePrefixes):
+		msg.Kind = AuthFailure
+		return msg
+	case hasAnyPrefix(lower, rateLimitPrefixes):
+		msg.Kind = RateLimit
+		return msg
+	case hasAnyPrefix(lower, errorPrefixes):
+		msg.Kind = Error
+		return msg
+	case hasAnyPrefix(lower, warningPrefixes):
+		msg.Kind = Warning
+		return msg
+	}
+
+	fields := strings.Fields(text)
+	for _, field := range fields {
+		if !urlRegexp.MatchString(field) {
+			return msg
+		}
+	}
+	if len(fields) > 0 {
+		msg.Kind = Urls
+		for _, url := range fields {
+			msg.Urls = append(msg.Urls, strings.TrimRight(url, ".,;)"))
+		}
+	}
+	return msg
+}
@@ -0,0 +1,116 @@
+package servermsg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		line string
+		kind Kind
+		urls []string
+		in   time.Duration
+	}{
+		{line: "\x1b[32mhttp://abc.a.pinggy.link\x1b[0m\r", kind: Urls, urls: []string{"http://abc.a.pinggy.link"}},
+		{line: "tcp://abc.a.pinggy.link:40000 https://abc.a.pinggy.link.", kind: Urls, urls: []string{"tcp://abc.a.pinggy.link:40000", "https://abc.a.pinggy.link"}},
+		{line: "Your tunnel will expire in 60 minutes. Upgrade at https://dashboard.pinggy.io", kind: Expiry, in: time.Hour},
+		{line: "You are not authenticated.", kind: Warning},
+		{line: "Authentication failed: invalid token", kind: AuthFailure},
+		{line: "Too many active tunnels for this token", kind: RateLimit},
+		{line: "Error: could not allocate a port", kind: Error},
+		{line: "Welcome to pinggy", kind: Text},
+	}
+	for _, test := range tests {
+		msg := Parse(test.line, now)
+		if msg.Kind != test.kind {
+			t.Errorf("%q: got kind %v, want %v", test.line, msg.Kind, test.kind)
+			continue
+		}
+		if len(msg.Urls) != len(test.urls) {
+			t.Errorf("%q: got urls %v, want %v", test.line, msg.Urls, test.urls)
+			continue
+		}
+		for i := range test.urls {
+			if msg.Urls[i] != test.urls[i] {
+				t.Errorf("%q: got urls %v, want %v", test.line, msg.Urls, test.urls)
+			}
+		}
+		if msg.ExpiresIn != test.in {
+			t.Errorf("%q: got expiry %v, want %v", test.line, msg.ExpiresIn, test.in)
+		}
+		if test.in != 0 && !msg.ExpiresAt.Equal(now.Add(test.in)) {
+			t.Errorf("%q: got expiry time %v", test.line, msg.ExpiresAt)
+		}
+	}
+}
+
+/*
+The fixtures hold the banner of free tunnels, as printed on the session.
+*/
+func TestParseBanner(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		file  string
+		kinds []Kind
+		urls  []string
+	}{
+		{
+			"free_http.txt",
+			[]Kind{Warning, Expiry, Text, Urls, Urls},
+			[]string{"http://rnbxq-203-0-113-7.a.free.pinggy.link", "https://rnbxq-203-0-113-7.a.free.pinggy.link"},
+		},
+		{
+			"free_tcp.txt",
+			[]Kind{Warning, Expiry, Text, Urls},
+			[]string{"tcp://rnbxq-203-0-113-7.a.free.pinggy.link:40123"},
+		},
+	}
+	for _, test := range tests {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+		if len(lines) != len(test.kinds) {
+			t.Fatalf("%s: expected %d lines, got %d", test.file, len(test.kinds), len(lines))
+		}
+		urls := []string{}
+		for i, line := range lines {
+			msg := Parse(line, now)
+			if msg.Kind != test.kinds[i] {
+				t.Errorf("%s: %q: got kind %v, want %v", test.file, line, msg.Kind, test.kinds[i])
+			}
+			urls = append(urls, msg.Urls...)
+		}
+		if strings.Join(urls, " ") != strings.Join(test.urls, " ") {
+			t.Errorf("%s: got urls %v, want %v", test.file, urls, test.urls)
+		}
+	}
+}
+
+func TestParseNoKeywordMatches(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		line string
+		kind Kind
+	}{
+		// Words of other kinds inside urls or free text.
+		{"http://errors.a.pinggy.link", Urls},
+		{"https://rate-limit-test.a.pinggy.link/too-many", Urls},
+		{"Upgrade to Pinggy Pro to get unrestricted tunnels. https://dashboard.pinggy.io", Text},
+		{"Documentation about error codes: https://pinggy.io/docs", Text},
+		{"The quota of your plan is 1 tunnel", Text},
+		{"Tunnels do not expire in 60 minutes with Pinggy Pro", Text},
+		{"Unauthorized visitors get a 401", Text},
+	}
+	for _, test := range tests {
+		if msg := Parse(test.line, now); msg.Kind != test.kind {
+			t.Errorf("%q: got kind %v, want %v", test.line, msg.Kind, test.kind)
+		}
+	}
+}
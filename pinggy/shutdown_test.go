@@ -0,0 +1,117 @@
+package pinggy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+trackFakeConn hands a pipe to the tracker of pl, as Accept does for visitors.
+*/
+func trackFakeConn(t *testing.T, pl *pinggyListener) net.Conn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	return pl.tracker.Track(local)
+}
+
+func expectClosed(t *testing.T, pl *pinggyListener) {
+	t.Helper()
+	if _, err := pl.Accept(); err == nil {
+		t.Fatal("accepted after shutdown")
+	}
+	if !pl.isClosed() {
+		t.Fatal("listener not closed")
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+	conns := []net.Conn{trackFakeConn(t, pl), trackFakeConn(t, pl)}
+	go func() {
+		for _, conn := range conns {
+			time.Sleep(100 * time.Millisecond)
+			conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	n, err := pl.Shutdown(context.Background())
+	if n != 0 || err != nil {
+		t.Fatalf("expected a clean shutdown, got %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("shutdown returned before the connections were closed, after %v", elapsed)
+	}
+	expectClosed(t, pl)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+	conns := []net.Conn{trackFakeConn(t, pl), trackFakeConn(t, pl), trackFakeConn(t, pl)}
+	conns[0].Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	n, err := pl.Shutdown(ctx)
+	if n != 2 || err != context.DeadlineExceeded {
+		t.Fatalf("expected 2 force closed connections, got %d, %v", n, err)
+	}
+	// The force closed connections cannot be used anymore.
+	for i, conn := range conns[1:] {
+		if _, err := conn.Write([]byte("x")); err == nil {
+			t.Fatalf("connection %d still open", i+1)
+		}
+	}
+	expectClosed(t, pl)
+}
+
+func TestShutdownConcurrentClose(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+	conn := trackFakeConn(t, pl)
+
+	type result struct {
+		n   int
+		err error
+	}
+	shutdown := make(chan result, 1)
+	go func() {
+		n, err := pl.Shutdown(context.Background())
+		shutdown <- result{n, err}
+	}()
+	waitFor(t, "shutdown", func() bool {
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
+		return pl.shuttingDown
+	})
+
+	// Close while Shutdown waits for conn, from several goroutines.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pl.Close()
+		}()
+	}
+	wg.Wait()
+	conn.Close()
+
+	select {
+	case r := <-shutdown:
+		if r.n != 0 || r.err != nil {
+			t.Fatalf("expected a clean shutdown, got %d, %v", r.n, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown still waiting after close")
+	}
+	expectClosed(t, pl)
+	if n, err := pl.Shutdown(context.Background()); n != 0 || err != nil {
+		t.Fatalf("shutdown after close: %d, %v", n, err)
+	}
+}
@@ -1,6 +1,10 @@
 package socks
 
-import "net"
+import (
+	"net"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+)
 
 type ConnType int
 
@@ -39,4 +43,5 @@ type Socks5u interface {
 	StripSockFromConn(net.Conn) (net.Addr, ConnType, error)
 	AcceptAndStripSock(net.Listener) (net.Conn, net.Addr, ConnType, error)
 	Start()
+	SetLogger(logging.Logger)
 }
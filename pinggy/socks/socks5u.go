@@ -3,9 +3,10 @@ package socks
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strings"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
 )
 
 type strippedConn struct {
@@ -19,6 +20,8 @@ type socksStriper struct {
 
 	udpConnections chan *strippedConn
 	tcpConnections chan *strippedConn
+
+	logger logging.Logger
 }
 
 func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cType ConnType, err error) {
@@ -28,14 +31,14 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 	// Perform handshake
 	version, nmethods, err := readHandshake(clientConn)
 	if err != nil {
-		log.Println("Error during handshake:", err)
+		s.logger.Warn("error during socks handshake", "err", err)
 		return
 	}
 
 	// Only support SOCKS5
 	if version != 5 {
 		err = fmt.Errorf("unsupported socks version")
-		log.Println("Unsupported SOCKS version:", version)
+		s.logger.Warn("unsupported socks version", "version", version)
 		return
 	}
 
@@ -43,7 +46,7 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 	// Read and discard methods
 	_, err = io.ReadFull(clientConn, methods)
 	if err != nil {
-		log.Println("Error reading methods:", err)
+		s.logger.Warn("error reading socks methods", "err", err)
 		return
 	}
 	acceptedMethod := byte(255)
@@ -55,7 +58,7 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 	// Respond to the client with a "no authentication required" message
 	_, err = clientConn.Write([]byte{5, acceptedMethod})
 	if err != nil {
-		log.Println("Error responding to client:", err)
+		s.logger.Warn("error responding to socks client", "err", err)
 		return
 	}
 
@@ -67,7 +70,7 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 	// Read the request
 	cmd, addrStr, err := readRequest(clientConn)
 	if err != nil {
-		log.Println("Error reading request:", err)
+		s.logger.Warn("error reading socks request", "err", err)
 		return
 	}
 
@@ -94,11 +97,11 @@ func (s *socksStriper) StripSockFromConn(clientConn net.Conn) (addr net.Addr, cT
 	_, err1 := clientConn.Write([]byte{5, byte(reply), 0, 1, 0, 0, 0, 0, 0, 0})
 	if err1 != nil {
 		err = err1
-		log.Println("Error responding to client:", err)
+		s.logger.Warn("error responding to socks client", "err", err)
 		return
 	}
 
-	log.Println("Striping done")
+	s.logger.Debug("socks header stripped", "addr", addr, "type", cType)
 	return
 }
 
@@ -107,7 +110,7 @@ func (s *socksStriper) AcceptAndStripSock(listener net.Listener) (clientConn net
 
 	clientConn, err = listener.Accept()
 	if err != nil {
-		log.Println("Error while accepting a connection: ", err)
+		s.logger.Warn("error while accepting a connection", "err", err)
 		return
 	}
 
@@ -125,22 +128,21 @@ func (s *socksStriper) Start() {
 	for {
 		clientConn, err := s.listener.Accept()
 		if err != nil {
-			log.Println("Error while accepting a connection: ", err)
+			s.logger.Warn("error while accepting a connection", "err", err)
 			s.udpConnections <- &strippedConn{err: err}
 			s.tcpConnections <- &strippedConn{err: err}
 			return
 		}
 
 		go func(clientConn net.Conn) {
-			log.Println("Connection accepted")
+			s.logger.Debug("socks connection accepted", "remote", clientConn.RemoteAddr())
 			addr, cType, err := s.StripSockFromConn(clientConn)
 			if err != nil {
 				clientConn.Close()
 				clientConn = nil
-				log.Println("Error while striping: ", err)
+				s.logger.Warn("error while stripping socks header", "err", err)
 				return
 			}
-			log.Println("Connection striped, ", addr, " ", cType, " ")
 			if ConnType_UDP == cType {
 				s.udpConnections <- &strippedConn{conn: clientConn, addr: addr}
 			} else if ConnType_TCP == cType {
@@ -151,13 +153,11 @@ func (s *socksStriper) Start() {
 }
 
 func (s *socksStriper) AcceptTcp() (net.Conn, net.Addr, error) {
-	log.Println("Trying to accept tcp")
 	sock := <-s.tcpConnections
 	return sock.conn, sock.addr, sock.err
 }
 
 func (s *socksStriper) AcceptUdp() (net.Conn, net.Addr, error) {
-	log.Println("Trying to accept Udp")
 	sock := <-s.udpConnections
 	return sock.conn, sock.addr, sock.err
 }
@@ -175,11 +175,16 @@ func (s *socksStriper) Addr() net.Addr {
 	return s.listener.Addr()
 }
 
+func (s *socksStriper) SetLogger(logger logging.Logger) {
+	s.logger = logging.OrNop(logger)
+}
+
 func InitiatateSocks5u(listener net.Listener) Socks5u {
 	return &socksStriper{
 		listener:       listener,
 		udpConnections: make(chan *strippedConn, 5),
 		tcpConnections: make(chan *strippedConn, 5),
+		logger:         logging.Nop(),
 	}
 }
 
@@ -0,0 +1,348 @@
+package pinggy
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+testServerOutput is printed on every session, as the pinggy server does.
+*/
+const testServerOutput = "You are not authenticated.\r\n" +
+	"Your tunnel will expire in 60 minutes. Upgrade to Pinggy Pro to get unrestricted tunnels. https://dashboard.pinggy.io\r\n" +
+	"http://abc.a.pinggy.link\r\n" +
+	"https://abc.a.pinggy.link\r\n"
+
+/*
+testServer is an in-process ssh server standing in for the pinggy server. It
+accepts any credentials, grants the remote forwarding, prints
+testServerOutput on sessions and serves the tunnel api.
+*/
+type testServer struct {
+	listener net.Listener
+	signer   ssh.Signer
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+	// Number of tcp connections accepted, including refused ones.
+	dials int
+	// New connections are closed right away.
+	down bool
+	// Keepalive requests are not answered.
+	noReply bool
+	// Commands of the sessions, "shell" for a shell.
+	commands []string
+	// Exec requests are refused.
+	failExec bool
+	// Bodies of the header manipulation requests.
+	headers []string
+	// Status returned to header manipulation requests, 200 if not set.
+	headerStatus int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: listener, signer: signer}
+	t.Cleanup(func() {
+		listener.Close()
+		s.dropAll()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+/*
+connect connects a listener with conf to the server, closing it at the end
+of the test.
+*/
+func (s *testServer) connect(t *testing.T, conf Config) *pinggyListener {
+	t.Helper()
+	conf.Server = s.addr()
+	pl, err := ConnectWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pl.Close() })
+	return pl.(*pinggyListener)
+}
+
+func (s *testServer) dropAll() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+/*
+setDown simulates an outage, dropping the connections and refusing new ones,
+or ends it.
+*/
+func (s *testServer) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+	if down {
+		s.dropAll()
+	}
+}
+
+func (s *testServer) setNoReply(noReply bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noReply = noReply
+}
+
+func (s *testServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *testServer) setFailExec(failExec bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failExec = failExec
+}
+
+func (s *testServer) sessionCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *testServer) setHeaderStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.headerStatus = status
+}
+
+func (s *testServer) headerRequests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.headers...)
+}
+
+func (s *testServer) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.dials++
+		down := s.down
+		s.mu.Unlock()
+		if down {
+			conn.Close()
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(s.signer)
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.mu.Unlock()
+
+	go s.handleRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go s.handleSession(channel, requests)
+		case "direct-tcpip":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go s.serveApi(channel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func (s *testServer) handleRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		switch req.Type {
+		case "tcpip-forward":
+			port := make([]byte, 4)
+			binary.BigEndian.PutUint32(port, 40000)
+			req.Reply(true, port)
+		case "keepalive@openssh.com":
+			s.mu.Lock()
+			noReply := s.noReply
+			s.mu.Unlock()
+			if !noReply {
+				req.Reply(false, nil)
+			}
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *testServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		s.mu.Lock()
+		ok := true
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			s.commands = append(s.commands, payload.Command)
+			ok = !s.failExec
+		case "shell":
+			s.commands = append(s.commands, "shell")
+		}
+		s.mu.Unlock()
+		req.Reply(ok, nil)
+		if ok && (req.Type == "exec" || req.Type == "shell") {
+			io.WriteString(channel, testServerOutput)
+		}
+	}
+}
+
+/*
+serveApi answers the requests of the control client.
+*/
+func (s *testServer) serveApi(channel ssh.Channel) {
+	defer channel.Close()
+	reader := bufio.NewReader(channel)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		status := http.StatusOK
+		var resp string
+		switch req.URL.Path {
+		case "/urls":
+			resp = `{"urls":["http://abc.a.pinggy.link","https://abc.a.pinggy.link"]}`
+		case "/headerman":
+			s.mu.Lock()
+			s.headers = append(s.headers, string(body))
+			if s.headerStatus != 0 {
+				status = s.headerStatus
+			}
+			s.mu.Unlock()
+			resp = `{}`
+		default:
+			status = http.StatusNotFound
+		}
+		fmt.Fprintf(channel, "HTTP/1.1 %d %s\r\nContent-Length: %d\r\nContent-Type: application/json\r\n\r\n%s",
+			status, http.StatusText(status), len(resp), resp)
+	}
+}
+
+/*
+openVisitor opens a forwarded-tcpip channel on the latest connection, as the
+server does for every visitor.
+*/
+func (s *testServer) openVisitor(t *testing.T) net.Conn {
+	t.Helper()
+	s.mu.Lock()
+	if len(s.conns) == 0 {
+		s.mu.Unlock()
+		t.Fatal("no connection")
+	}
+	serverConn := s.conns[len(s.conns)-1]
+	s.mu.Unlock()
+
+	payload := struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{"0.0.0.0", 40000, "203.0.113.7", 5555}
+	channel, requests, err := serverConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(requests)
+	return &channelConn{Channel: channel}
+}
+
+type channelConn struct {
+	ssh.Channel
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero, Port: 40000}
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}
+}
+
+func (c *channelConn) SetDeadline(time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(time.Time) error { return nil }
+
+/*
+waitFor polls cond until it holds, failing the test after a few seconds.
+*/
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,181 @@
+package pinggy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+Terminate the tls of visitors locally. The certificate is taken from
+CertFile and KeyFile, or Certificate. Without any of them, a self-signed
+certificate is generated for the tunnel hostname.
+*/
+type TlsTerminationConfig struct {
+	/*
+		PEM encoded certificate chain and private key.
+	*/
+	CertFile string
+	KeyFile  string
+
+	Certificate *tls.Certificate
+
+	/*
+		Base tls config, e.g. for NextProtos or client authentication. Its
+		certificates are replaced by the ones above.
+	*/
+	TlsConfig *tls.Config
+}
+
+func verifyTlsTermination(cerr *ConfigError, conf *Config) {
+	tconf := conf.TlsTermination
+	if conf.Type != TLS && conf.Type != TLSTCP {
+		cerr.add("TlsTermination", "tls termination is available only with %v and %v modes", TLS, TLSTCP)
+	}
+	if (tconf.CertFile == "") != (tconf.KeyFile == "") {
+		cerr.add("TlsTermination", "CertFile and KeyFile must be set together")
+	}
+	if tconf.CertFile != "" && tconf.Certificate != nil {
+		cerr.add("TlsTermination", "CertFile and Certificate cannot be used together")
+	}
+}
+
+/*
+tlsTerminator provides the certificates of TlsTerminationConfig, generating
+a self-signed one on demand.
+*/
+type tlsTerminator struct {
+	config   *tls.Config
+	hostname func() string
+
+	mu             sync.Mutex
+	selfSigned     *tls.Certificate
+	selfSignedName string
+}
+
+/*
+newTlsTerminator loads the configured certificate. hostname is only called
+once visitors connect, to name the self-signed certificate.
+*/
+func newTlsTerminator(tconf *TlsTerminationConfig, hostname func() string) (*tlsTerminator, error) {
+	t := &tlsTerminator{hostname: hostname}
+	if tconf.TlsConfig != nil {
+		t.config = tconf.TlsConfig.Clone()
+	} else {
+		t.config = &tls.Config{}
+	}
+	t.config.Certificates = nil
+	t.config.GetCertificate = nil
+
+	if tconf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tconf.CertFile, tconf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load tls certificate: %v", err)
+		}
+		t.config.Certificates = []tls.Certificate{cert}
+	} else if tconf.Certificate != nil {
+		t.config.Certificates = []tls.Certificate{*tconf.Certificate}
+	} else {
+		t.config.GetCertificate = t.getSelfSigned
+	}
+	return t, nil
+}
+
+func (t *tlsTerminator) listener(l net.Listener) net.Listener {
+	return tls.NewListener(l, t.config)
+}
+
+/*
+getSelfSigned returns the certificate for the tunnel hostname, or localhost
+as long as it is not known. The server name sent by the visitor is ignored,
+so that visitors cannot make us generate a key per name.
+*/
+func (t *tlsTerminator) getSelfSigned(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := t.hostname()
+	if name == "" {
+		name = "localhost"
+	}
+
+	t.mu.Lock()
+	cert := t.selfSigned
+	current := t.selfSignedName == name
+	t.mu.Unlock()
+	if cert != nil && current {
+		return cert, nil
+	}
+
+	// The key is generated without holding t.mu, not to hold up the other
+	// handshakes.
+	cert, err := selfSignedCertificate(name)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.selfSigned != nil && t.selfSignedName == name {
+		// Generated concurrently.
+		return t.selfSigned, nil
+	}
+	t.selfSigned = cert
+	t.selfSignedName = name
+	return cert, nil
+}
+
+func selfSignedCertificate(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: template}, nil
+}
+
+/*
+tunnelHost returns the hostname of the first url of the tunnel, or an empty
+string if it is not known.
+*/
+func (pl *pinggyListener) tunnelHost() string {
+	pl.urlsMu.Lock()
+	urls := pl.lastUrls
+	pl.urlsMu.Unlock()
+	if len(urls) == 0 {
+		urls = pl.getConnectionUrl()
+	}
+	for _, u := range urls {
+		if parsed, err := url.Parse(u); err == nil && parsed.Hostname() != "" {
+			return parsed.Hostname()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package pinggy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+handshake connects a tls client sending serverName to a visitor accepted by
+the listener of t, and returns the certificate presented.
+*/
+func handshake(tt *testing.T, t *tlsTerminator, serverName string) *x509.Certificate {
+	tt.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	tlsListener := t.listener(ln)
+	defer tlsListener.Close()
+	go func() {
+		conn, err := tlsListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: serverName, NextProtos: []string{"h2"}})
+	if err != nil {
+		tt.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTlsTerminationSelfSigned(t *testing.T) {
+	var mu sync.Mutex
+	hostname := ""
+	terminator, err := newTlsTerminator(&TlsTerminationConfig{}, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return hostname
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tunnel host is not known yet.
+	cert := handshake(t, terminator, "")
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "localhost" {
+		t.Fatalf("unexpected names %v", cert.DNSNames)
+	}
+
+	mu.Lock()
+	hostname = "abc.a.pinggy.link"
+	mu.Unlock()
+	cert = handshake(t, terminator, "")
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "abc.a.pinggy.link" {
+		t.Fatalf("unexpected names %v", cert.DNSNames)
+	}
+
+	// The server names sent by visitors do not issue new certificates.
+	for _, serverName := range []string{"abc.a.pinggy.link", "other.example.com", "another.example.com"} {
+		other := handshake(t, terminator, serverName)
+		if other.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			t.Fatalf("%s: new certificate issued for %v", serverName, other.DNSNames)
+		}
+	}
+}
+
+func TestTlsTerminationSelfSignedIp(t *testing.T) {
+	terminator, err := newTlsTerminator(&TlsTerminationConfig{}, func() string { return "203.0.113.1" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := handshake(t, terminator, "")
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("203.0.113.1")) {
+		t.Fatalf("unexpected addresses %v", cert.IPAddresses)
+	}
+}
+
+func TestTlsTerminationSelfSignedConcurrent(t *testing.T) {
+	terminator, err := newTlsTerminator(&TlsTerminationConfig{}, func() string { return "abc.a.pinggy.link" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := make([]*tls.Certificate, 8)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			certs[i], _ = terminator.getSelfSigned(&tls.ClientHelloInfo{})
+		}(i)
+	}
+	wg.Wait()
+	cert, err := terminator.getSelfSigned(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range certs {
+		if other == nil {
+			t.Fatal("no certificate")
+		}
+	}
+	if again, _ := terminator.getSelfSigned(&tls.ClientHelloInfo{ServerName: "other.example.com"}); again != cert {
+		t.Fatal("certificate not reused")
+	}
+}
+
+func TestTlsTerminationCertFile(t *testing.T) {
+	cert, err := selfSignedCertificate("tls.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := func() string {
+		t.Error("hostname called with a configured certificate")
+		return ""
+	}
+	terminator, err := newTlsTerminator(&TlsTerminationConfig{
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+		TlsConfig: &tls.Config{NextProtos: []string{"h2"}, MinVersion: tls.VersionTLS12},
+	}, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terminator.config.MinVersion != tls.VersionTLS12 || len(terminator.config.NextProtos) != 1 {
+		t.Fatal("base tls config not kept")
+	}
+	if presented := handshake(t, terminator, "other.example.com"); presented.DNSNames[0] != "tls.example.com" {
+		t.Fatalf("unexpected names %v", presented.DNSNames)
+	}
+
+	terminator, err = newTlsTerminator(&TlsTerminationConfig{Certificate: cert}, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if presented := handshake(t, terminator, ""); presented.DNSNames[0] != "tls.example.com" {
+		t.Fatalf("unexpected names %v", presented.DNSNames)
+	}
+
+	_, err = newTlsTerminator(&TlsTerminationConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")}, hostname)
+	if err == nil {
+		t.Fatal("expected an error for a missing key file")
+	}
+}
+
+func TestVerifyTlsTermination(t *testing.T) {
+	tests := []struct {
+		conf  Config
+		valid bool
+	}{
+		{Config{Type: TLS, TlsTermination: &TlsTerminationConfig{}}, true},
+		{Config{Type: TLSTCP, TlsTermination: &TlsTerminationConfig{CertFile: "cert.pem", KeyFile: "key.pem"}}, true},
+		{Config{Type: HTTP, TlsTermination: &TlsTerminationConfig{}}, false},
+		{Config{Type: TLS, TlsTermination: &TlsTerminationConfig{KeyFile: "key.pem"}}, false},
+		{Config{Type: TLS, TlsTermination: &TlsTerminationConfig{CertFile: "cert.pem", KeyFile: "key.pem", Certificate: &tls.Certificate{}}}, false},
+	}
+	for i, test := range tests {
+		cerr := &ConfigError{}
+		verifyTlsTermination(cerr, &test.conf)
+		if valid := cerr.errOrNil() == nil; valid != test.valid {
+			t.Errorf("config %d: expected valid %v, got %v", i, test.valid, cerr.errOrNil())
+		}
+	}
+}
+
+func TestSelfSignedCertificateValidity(t *testing.T) {
+	cert, err := selfSignedCertificate("abc.a.pinggy.link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.VerifyHostname("abc.a.pinggy.link"); err != nil {
+		t.Fatal(err)
+	}
+	if now := time.Now(); now.Before(parsed.NotBefore) || now.After(parsed.NotAfter) {
+		t.Fatalf("not valid now: %v - %v", parsed.NotBefore, parsed.NotAfter)
+	}
+}
@@ -0,0 +1,365 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type BalanceStrategy string
+
+const (
+	RoundRobin       BalanceStrategy = "round-robin"
+	LeastConnections BalanceStrategy = "least-connections"
+	Weighted         BalanceStrategy = "weighted"
+)
+
+type Backend struct {
+	/*
+		Address of the backend, `host:port`.
+	*/
+	Addr string
+
+	/*
+		Relative share of the connections with the weighted strategy, and
+		capacity with least-connections. Default 1.
+	*/
+	Weight int
+}
+
+type BalancerConfig struct {
+	Backends []Backend
+
+	/*
+		How the backend of a new connection is chosen. Default round-robin.
+	*/
+	Strategy BalanceStrategy
+
+	/*
+		Interval between active health checks, which try to open a tcp
+		connection to every backend. Zero disables them.
+	*/
+	HealthCheckInterval time.Duration
+
+	/*
+		Timeout of a health check and of connecting to a backend. Default 5 seconds.
+	*/
+	DialTimeout time.Duration
+
+	/*
+		Number of failed connection attempts in a row after which a backend is
+		ejected. Default 3.
+	*/
+	MaxFails int
+
+	/*
+		How long an ejected backend is skipped, unless a health check finds it
+		healthy earlier. Default 30 seconds.
+	*/
+	FailTimeout time.Duration
+}
+
+/*
+State of a backend, as seen by the balancer.
+*/
+type BackendStatus struct {
+	Backend
+	Healthy           bool
+	ActiveConnections int
+	ConsecutiveFails  int
+	EjectedUntil      time.Time
+}
+
+type BalancedTcpDialer interface {
+	TcpDialer
+
+	/*
+		Current state of every backend.
+	*/
+	Backends() []BackendStatus
+
+	/*
+		Stop the health checks.
+	*/
+	Close() error
+}
+
+type backendState struct {
+	BackendStatus
+	currentWeight int
+}
+
+type balancedTcpDialer struct {
+	conf BalancerConfig
+
+	mu       sync.Mutex
+	backends []*backendState
+	next     int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/*
+Verify checks the balancer config without starting anything.
+*/
+func (conf *BalancerConfig) Verify() error {
+	if len(conf.Backends) == 0 {
+		return fmt.Errorf("no backend configured")
+	}
+	switch conf.Strategy {
+	case "", RoundRobin, LeastConnections, Weighted:
+	default:
+		return fmt.Errorf("unknown balance strategy %q", conf.Strategy)
+	}
+	for i, backend := range conf.Backends {
+		if _, _, err := net.SplitHostPort(backend.Addr); err != nil {
+			return fmt.Errorf("backend %d: %v", i, err)
+		}
+		if backend.Weight < 0 {
+			return fmt.Errorf("backend %d: weight must not be negative", i)
+		}
+	}
+	if conf.HealthCheckInterval < 0 || conf.DialTimeout < 0 || conf.FailTimeout < 0 || conf.MaxFails < 0 {
+		return fmt.Errorf("intervals, timeouts and MaxFails must not be negative")
+	}
+	return nil
+}
+
+func NewBalancedTcpDialer(conf BalancerConfig) (BalancedTcpDialer, error) {
+	if err := conf.Verify(); err != nil {
+		return nil, err
+	}
+	if conf.Strategy == "" {
+		conf.Strategy = RoundRobin
+	}
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = 5 * time.Second
+	}
+	if conf.MaxFails == 0 {
+		conf.MaxFails = 3
+	}
+	if conf.FailTimeout == 0 {
+		conf.FailTimeout = 30 * time.Second
+	}
+
+	d := &balancedTcpDialer{conf: conf, done: make(chan struct{})}
+	d.setBackends(conf.Backends)
+	if conf.HealthCheckInterval > 0 {
+		go d.healthCheck()
+	}
+	return d, nil
+}
+
+func (d *balancedTcpDialer) setBackends(backends []Backend) {
+	states := make([]*backendState, 0, len(backends))
+	for _, backend := range backends {
+		if backend.Weight == 0 {
+			backend.Weight = 1
+		}
+		states = append(states, &backendState{BackendStatus: BackendStatus{Backend: backend, Healthy: true}})
+	}
+	d.mu.Lock()
+	d.backends = states
+	d.next = 0
+	d.mu.Unlock()
+}
+
+func (b *backendState) available(now time.Time) bool {
+	return b.Healthy && now.After(b.EjectedUntil)
+}
+
+// pick expects d.mu to be held. Backends in skip were tried already.
+func (d *balancedTcpDialer) pick(skip map[*backendState]bool) *backendState {
+	now := time.Now()
+	candidates := []*backendState{}
+	for _, backend := range d.backends {
+		if !skip[backend] && backend.available(now) {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		// Better try an unhealthy backend than failing right away.
+		for _, backend := range d.backends {
+			if !skip[backend] {
+				candidates = append(candidates, backend)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch d.conf.Strategy {
+	case LeastConnections:
+		var best *backendState
+		for i := range candidates {
+			// Start after the last pick, so that ties are spread.
+			backend := candidates[(d.next+i)%len(candidates)]
+			if best == nil || backend.ActiveConnections*best.Weight < best.ActiveConnections*backend.Weight {
+				best = backend
+			}
+		}
+		d.next += 1
+		return best
+	case Weighted:
+		// Smooth weighted round robin, as done by nginx.
+		total := 0
+		var best *backendState
+		for _, backend := range candidates {
+			backend.currentWeight += backend.Weight
+			total += backend.Weight
+			if best == nil || backend.currentWeight > best.currentWeight {
+				best = backend
+			}
+		}
+		best.currentWeight -= total
+		return best
+	default:
+		backend := candidates[d.next%len(candidates)]
+		d.next += 1
+		return backend
+	}
+}
+
+func (d *balancedTcpDialer) Dial() (net.Conn, error) {
+	tried := make(map[*backendState]bool)
+	var lastErr error
+	for {
+		d.mu.Lock()
+		backend := d.pick(tried)
+		if backend == nil {
+			d.mu.Unlock()
+			return nil, lastErr
+		}
+		backend.ActiveConnections += 1
+		addr := backend.Addr
+		d.mu.Unlock()
+		tried[backend] = true
+
+		conn, err := net.DialTimeout("tcp", addr, d.conf.DialTimeout)
+		d.mu.Lock()
+		if err != nil {
+			backend.ActiveConnections -= 1
+			backend.ConsecutiveFails += 1
+			if backend.ConsecutiveFails >= d.conf.MaxFails {
+				backend.EjectedUntil = time.Now().Add(d.conf.FailTimeout)
+			}
+			d.mu.Unlock()
+			lastErr = err
+			continue
+		}
+		backend.ConsecutiveFails = 0
+		backend.EjectedUntil = time.Time{}
+		d.mu.Unlock()
+		return &balancedConn{Conn: conn, dialer: d, backend: backend}, nil
+	}
+}
+
+type balancedConn struct {
+	net.Conn
+	dialer  *balancedTcpDialer
+	backend *backendState
+	once    sync.Once
+}
+
+func (c *balancedConn) Close() error {
+	c.once.Do(func() {
+		c.dialer.mu.Lock()
+		c.backend.ActiveConnections -= 1
+		c.dialer.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (d *balancedTcpDialer) healthCheck() {
+	ticker := time.NewTicker(d.conf.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		backends := append([]*backendState{}, d.backends...)
+		d.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, backend := range backends {
+			wg.Add(1)
+			go func(backend *backendState) {
+				defer wg.Done()
+				d.mu.Lock()
+				addr := backend.Addr
+				d.mu.Unlock()
+				conn, err := net.DialTimeout("tcp", addr, d.conf.DialTimeout)
+				if err == nil {
+					conn.Close()
+				}
+				d.mu.Lock()
+				backend.Healthy = err == nil
+				if err == nil {
+					backend.ConsecutiveFails = 0
+					backend.EjectedUntil = time.Time{}
+				}
+				d.mu.Unlock()
+			}(backend)
+		}
+		wg.Wait()
+	}
+}
+
+func (d *balancedTcpDialer) Backends() []BackendStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := make([]BackendStatus, 0, len(d.backends))
+	for _, backend := range d.backends {
+		statuses = append(statuses, backend.BackendStatus)
+	}
+	return statuses
+}
+
+/*
+GetAddr returns the address of the first available backend.
+*/
+func (d *balancedTcpDialer) GetAddr() net.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	addr := d.backends[0].Addr
+	for _, backend := range d.backends {
+		if backend.available(now) {
+			addr = backend.Addr
+			break
+		}
+	}
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return tcpAddr
+	}
+	return &backendAddr{addr}
+}
+
+/*
+UpdateAddr replaces every backend by addr.
+*/
+func (d *balancedTcpDialer) UpdateAddr(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	d.setBackends([]Backend{{Addr: addr.String()}})
+}
+
+func (d *balancedTcpDialer) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	return nil
+}
+
+type backendAddr struct {
+	addr string
+}
+
+func (a *backendAddr) Network() string { return "tcp" }
+func (a *backendAddr) String() string  { return a.addr }
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func listenBackend(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func dialCounts(t *testing.T, d BalancedTcpDialer, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn.RemoteAddr().String()] += 1
+		conn.Close()
+	}
+	return counts
+}
+
+func TestBalancerWeighted(t *testing.T) {
+	a, b := listenBackend(t), listenBackend(t)
+	defer a.Close()
+	defer b.Close()
+
+	d, err := NewBalancedTcpDialer(BalancerConfig{
+		Strategy: Weighted,
+		Backends: []Backend{{Addr: a.Addr().String(), Weight: 3}, {Addr: b.Addr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	counts := dialCounts(t, d, 8)
+	if counts[a.Addr().String()] != 6 || counts[b.Addr().String()] != 2 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestBalancerEjectsFailingBackend(t *testing.T) {
+	alive := listenBackend(t)
+	defer alive.Close()
+	dead := listenBackend(t)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	d, err := NewBalancedTcpDialer(BalancerConfig{
+		Backends:    []Backend{{Addr: deadAddr}, {Addr: alive.Addr().String()}},
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// The failing backend is skipped over and then ejected.
+	counts := dialCounts(t, d, 4)
+	if counts[alive.Addr().String()] != 4 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	for _, status := range d.Backends() {
+		if status.Addr == deadAddr && status.EjectedUntil.IsZero() {
+			t.Fatalf("backend %v not ejected", deadAddr)
+		}
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	l := listenBackend(t)
+	addr := l.Addr().String()
+	l.Close()
+
+	d, err := NewBalancedTcpDialer(BalancerConfig{
+		Backends:            []Backend{{Addr: addr}},
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Backends()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("backend still healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
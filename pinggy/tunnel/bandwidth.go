@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Bandwidth limits in bytes per second. Upload is the traffic sent to the
+visitors, download the traffic received from them. Zero means unlimited.
+*/
+type BandwidthLimits struct {
+	/*
+		Shared by every connection of the tunnel.
+	*/
+	UploadRate   int64
+	DownloadRate int64
+
+	/*
+		Applied to each connection on its own.
+	*/
+	ConnUploadRate   int64
+	ConnDownloadRate int64
+
+	/*
+		Bytes which can be transferred at once after an idle period, for every
+		limit. It defaults to one second worth of traffic.
+	*/
+	Burst int64
+}
+
+func (limits *BandwidthLimits) Verify() error {
+	if limits.UploadRate < 0 || limits.DownloadRate < 0 || limits.ConnUploadRate < 0 ||
+		limits.ConnDownloadRate < 0 || limits.Burst < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	return nil
+}
+
+/*
+Largest read or write done at once by a shaped connection. Small chunks let
+the waiting connections take turns on the shared limits, so that each of
+them gets a fair share.
+*/
+const maxShapedChunk = 16 * 1024
+
+/*
+BandwidthShaper limits the throughput of the connections it wraps. The
+limits can be changed at any time, active connections included.
+*/
+type BandwidthShaper struct {
+	mu       sync.Mutex
+	limits   BandwidthLimits
+	upload   *tokenBucket
+	download *tokenBucket
+	conns    map[*shapedConn]struct{}
+}
+
+func NewBandwidthShaper(limits BandwidthLimits) *BandwidthShaper {
+	s := &BandwidthShaper{
+		limits:   limits,
+		upload:   newTokenBucket(float64(limits.UploadRate), int(limits.Burst)),
+		download: newTokenBucket(float64(limits.DownloadRate), int(limits.Burst)),
+		conns:    make(map[*shapedConn]struct{}),
+	}
+	return s
+}
+
+func (s *BandwidthShaper) Limits() BandwidthLimits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits
+}
+
+func (s *BandwidthShaper) SetLimits(limits BandwidthLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+	s.upload.setRate(float64(limits.UploadRate), int(limits.Burst))
+	s.download.setRate(float64(limits.DownloadRate), int(limits.Burst))
+	for conn := range s.conns {
+		conn.upload.setRate(float64(limits.ConnUploadRate), int(limits.Burst))
+		conn.download.setRate(float64(limits.ConnDownloadRate), int(limits.Burst))
+	}
+}
+
+/*
+Conn wraps conn, limiting reads as download and writes as upload. A nil
+shaper returns conn as is.
+*/
+func (s *BandwidthShaper) Conn(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := &shapedConn{
+		Conn:     conn,
+		shaper:   s,
+		upload:   newTokenBucket(float64(s.limits.ConnUploadRate), int(s.limits.Burst)),
+		download: newTokenBucket(float64(s.limits.ConnDownloadRate), int(s.limits.Burst)),
+		done:     make(chan struct{}),
+	}
+	s.conns[sc] = struct{}{}
+	return sc
+}
+
+type shapedListener struct {
+	net.Listener
+	shaper *BandwidthShaper
+}
+
+func (l *shapedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.shaper.Conn(conn), nil
+}
+
+/*
+Listener wraps l so that every accepted connection is shaped.
+*/
+func (s *BandwidthShaper) Listener(l net.Listener) net.Listener {
+	if s == nil {
+		return l
+	}
+	return &shapedListener{Listener: l, shaper: s}
+}
+
+type shapedConn struct {
+	net.Conn
+	shaper   *BandwidthShaper
+	upload   *tokenBucket
+	download *tokenBucket
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+/*
+wait takes n bytes from the connection and tunnel buckets and sleeps until
+both allow them. It returns false if the connection got closed meanwhile.
+*/
+func (c *shapedConn) wait(conn, tunnel *tokenBucket, n int) bool {
+	delay := conn.reserve(float64(n))
+	if tunnelDelay := tunnel.reserve(float64(n)); tunnelDelay > delay {
+		delay = tunnelDelay
+	}
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	if len(b) > maxShapedChunk {
+		b = b[:maxShapedChunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.wait(c.download, c.shaper.download, n) && err == nil {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := len(b) - written
+		if chunk > maxShapedChunk {
+			chunk = maxShapedChunk
+		}
+		if !c.wait(c.upload, c.shaper.upload, chunk) {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *shapedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.shaper.mu.Lock()
+		delete(c.shaper.conns, c)
+		c.shaper.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
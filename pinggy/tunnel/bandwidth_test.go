@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func timedWrite(t *testing.T, conn net.Conn, size int) time.Duration {
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestBandwidthShaper(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	shaper := NewBandwidthShaper(BandwidthLimits{ConnUploadRate: 100000, Burst: 10000})
+	conn := shaper.Conn(local)
+	defer conn.Close()
+
+	// The burst goes through at once, the rest at the configured rate.
+	if elapsed := timedWrite(t, conn, 60000); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("60000 bytes at 100000 B/s took %v", elapsed)
+	}
+
+	// New limits apply to active connections.
+	shaper.SetLimits(BandwidthLimits{})
+	if elapsed := timedWrite(t, conn, 1<<20); elapsed > time.Second {
+		t.Fatalf("unlimited write took %v", elapsed)
+	}
+	shaper.SetLimits(BandwidthLimits{UploadRate: 50000, Burst: 5000})
+	if elapsed := timedWrite(t, conn, 40000); elapsed < 500*time.Millisecond {
+		t.Fatalf("40000 bytes at 50000 B/s took %v", elapsed)
+	}
+}
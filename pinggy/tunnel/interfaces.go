@@ -1,6 +1,12 @@
 package tunnel
 
-import "net"
+import (
+	"context"
+	"net"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+)
 
 type Dialer interface {
 	GetAddr() net.Addr
@@ -11,4 +17,59 @@ type TunnelManager interface {
 	StartForwarding()
 	AcceptAndForward() error
 	GetDialer() Dialer
+	SetLogger(logging.Logger)
+
+	/*
+		Snapshot of the metrics of the forwarded connections.
+	*/
+	Stats() ForwardingStats
+}
+
+/*
+The following interfaces are optional for a TunnelManager. The managers of
+this package implement all of them, the listener checks for them with a type
+assertion.
+*/
+
+type EventBusSetter interface {
+	/*
+		Publish connection events and forwarding failures on bus. It has to be
+		called before forwarding starts.
+	*/
+	SetEventBus(bus *events.Bus)
+}
+
+type LimitsSetter interface {
+	/*
+		Limit the forwarded connections. It has to be called before forwarding
+		starts.
+	*/
+	SetLimits(limits Limits)
+}
+
+type BandwidthShaperSetter interface {
+	/*
+		Shape the traffic of the forwarded connections with shaper, which can be
+		shared with other managers. It has to be called before forwarding starts.
+	*/
+	SetBandwidthShaper(shaper *BandwidthShaper)
+}
+
+type Drainer interface {
+	/*
+		Wait for the forwarded connections to finish. Connections still active
+		when ctx is done are closed; their number is returned with ctx.Err().
+		It does not stop accepting new connections, close the listener for that.
+	*/
+	Drain(ctx context.Context) (int, error)
+}
+
+type Stopper interface {
+	/*
+		Stop accepting: the accept loop returns before its next Accept, and a
+		wait for a free slot of Limits.Queue ends right away. It closes neither
+		the listener, which interrupts a pending Accept, nor the forwarded
+		connections.
+	*/
+	Stop()
 }
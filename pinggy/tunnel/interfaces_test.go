@@ -0,0 +1,54 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+)
+
+/*
+minimalManager implements only the required methods of TunnelManager, as
+managers outside of this package may do.
+*/
+type minimalManager struct{}
+
+func (minimalManager) StartForwarding()         {}
+func (minimalManager) AcceptAndForward() error  { return nil }
+func (minimalManager) GetDialer() Dialer        { return nil }
+func (minimalManager) SetLogger(logging.Logger) {}
+func (minimalManager) Stats() ForwardingStats   { return ForwardingStats{} }
+
+func TestOptionalManagerInterfaces(t *testing.T) {
+	var minimal TunnelManager = minimalManager{}
+	if _, ok := minimal.(Drainer); ok {
+		t.Fatal("minimal manager implements Drainer")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	managers := map[string]TunnelManager{
+		"tcp": NewTcpTunnelMangerAddr(listener, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}),
+		"udp": NewUdpTunnelMangerAddr(listener, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}),
+	}
+	for name, manager := range managers {
+		if _, ok := manager.(EventBusSetter); !ok {
+			t.Errorf("%s manager does not implement EventBusSetter", name)
+		}
+		if _, ok := manager.(LimitsSetter); !ok {
+			t.Errorf("%s manager does not implement LimitsSetter", name)
+		}
+		if _, ok := manager.(BandwidthShaperSetter); !ok {
+			t.Errorf("%s manager does not implement BandwidthShaperSetter", name)
+		}
+		if _, ok := manager.(Drainer); !ok {
+			t.Errorf("%s manager does not implement Drainer", name)
+		}
+		if _, ok := manager.(Stopper); !ok {
+			t.Errorf("%s manager does not implement Stopper", name)
+		}
+	}
+}
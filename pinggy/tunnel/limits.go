@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+)
+
+/*
+Limits on the connections forwarded by a TunnelManager. A udp session counts
+as a connection. Zero values disable the respective limit.
+*/
+type Limits struct {
+	/*
+		Maximum number of connections forwarded at the same time.
+	*/
+	MaxConnections int
+
+	/*
+		Maximum number of connections from a single visitor ip. Connections over
+		this limit are always rejected, as queueing them would let a single
+		visitor hold up the others.
+	*/
+	MaxConnectionsPerIp int
+
+	/*
+		Number of new connections accepted per second, and how many can be
+		accepted at once after a quiet period. AcceptBurst defaults to one
+		second worth of connections.
+	*/
+	AcceptRate  float64
+	AcceptBurst int
+
+	/*
+		Wait for MaxConnections and AcceptRate to allow a new connection instead
+		of rejecting it. Waiting visitors are kept on the server side, as the
+		tunnel stops accepting. Closing the manager ends the wait.
+	*/
+	Queue bool
+}
+
+var (
+	ErrConnectionLimit = errors.New("too many connections")
+	ErrVisitorLimit    = errors.New("too many connections from the visitor ip")
+	ErrAcceptRateLimit = errors.New("connection rate limit exceeded")
+)
+
+func (limits *Limits) Verify() error {
+	if limits.MaxConnections < 0 || limits.MaxConnectionsPerIp < 0 || limits.AcceptRate < 0 || limits.AcceptBurst < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+type connLimiter struct {
+	limits Limits
+	bucket *tokenBucket
+
+	// slots holds an element per forwarded connection. It is nil without
+	// MaxConnections.
+	slots chan struct{}
+
+	mu    sync.Mutex
+	perIp map[string]int
+}
+
+func newConnLimiter(limits Limits) *connLimiter {
+	l := &connLimiter{limits: limits, perIp: make(map[string]int)}
+	if limits.MaxConnections > 0 {
+		l.slots = make(chan struct{}, limits.MaxConnections)
+	}
+	if limits.AcceptRate > 0 {
+		l.bucket = newTokenBucket(limits.AcceptRate, limits.AcceptBurst)
+	}
+	return l
+}
+
+func (l *connLimiter) tryAcquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *connLimiter) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+/*
+reserve is called by the accept loop before accepting. When queueing, it
+waits for the rate limit and for a free slot, takes the slot and returns true.
+It gives up with ctx.Err() once ctx is done.
+*/
+func (l *connLimiter) reserve(ctx context.Context) (bool, error) {
+	if l == nil || !l.limits.Queue {
+		return false, nil
+	}
+	if l.bucket != nil {
+		if wait := l.bucket.reserve(1); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	if l.slots != nil {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case l.slots <- struct{}{}:
+		}
+	}
+	return true, nil
+}
+
+/*
+unreserve gives back the slot of reserve if accepting failed.
+*/
+func (l *connLimiter) unreserve(reserved bool) {
+	if l == nil || !reserved {
+		return
+	}
+	l.releaseSlot()
+}
+
+/*
+admit decides whether a connection from remoteAddr gets forwarded. The
+returned function has to be called once it is closed.
+*/
+func (l *connLimiter) admit(remoteAddr net.Addr, reserved bool) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	ip := remoteIp(remoteAddr)
+
+	if !reserved {
+		if !l.tryAcquire() {
+			return nil, ErrConnectionLimit
+		}
+		if l.bucket != nil && !l.bucket.allow(1) {
+			l.releaseSlot()
+			return nil, ErrAcceptRateLimit
+		}
+	}
+	perIp := l.limits.MaxConnectionsPerIp > 0 && ip != ""
+	if perIp {
+		l.mu.Lock()
+		if l.perIp[ip] >= l.limits.MaxConnectionsPerIp {
+			l.mu.Unlock()
+			l.releaseSlot()
+			return nil, ErrVisitorLimit
+		}
+		l.perIp[ip] += 1
+		l.mu.Unlock()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if perIp {
+				l.mu.Lock()
+				l.perIp[ip] -= 1
+				if l.perIp[ip] == 0 {
+					delete(l.perIp, ip)
+				}
+				l.mu.Unlock()
+			}
+			l.releaseSlot()
+		})
+	}, nil
+}
+
+func remoteIp(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case nil:
+		return ""
+	case *net.TCPAddr:
+		if addr == nil {
+			return ""
+		}
+		return addr.IP.String()
+	case *net.UDPAddr:
+		if addr == nil {
+			return ""
+		}
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+/*
+rejectConn closes a connection refused by the limits.
+*/
+func rejectConn(conn net.Conn, err error, logger logging.Logger, bus *events.Bus, stats *statsRecorder) {
+	logger.Warn("rejecting connection", "remote", conn.RemoteAddr(), "err", err)
+	bus.Publish(events.Event{Type: events.VisitorRejected, RemoteAddr: conn.RemoteAddr(), Err: err})
+	stats.rejected()
+	conn.Close()
+}
@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterReject(t *testing.T) {
+	l := newConnLimiter(Limits{MaxConnections: 3, MaxConnectionsPerIp: 2})
+	a := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("203.0.113.2"), Port: 1000}
+
+	releaseA1, err := l.admit(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(a, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(a, false); err != ErrVisitorLimit {
+		t.Fatalf("expected ErrVisitorLimit, got %v", err)
+	}
+	if _, err := l.admit(b, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(b, false); err != ErrConnectionLimit {
+		t.Fatalf("expected ErrConnectionLimit, got %v", err)
+	}
+
+	releaseA1()
+	releaseA1()
+	if _, err := l.admit(b, false); err != nil {
+		t.Fatalf("slot not released: %v", err)
+	}
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	l := newConnLimiter(Limits{MaxConnections: 1, Queue: true})
+	if reserved, err := l.reserve(context.Background()); !reserved || err != nil {
+		t.Fatalf("reserve did not reserve: %v", err)
+	}
+	release, err := l.admit(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved := make(chan bool)
+	go func() {
+		ok, _ := l.reserve(context.Background())
+		reserved <- ok
+	}()
+	select {
+	case <-reserved:
+		t.Fatal("reserved over MaxConnections")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-reserved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reserve still waiting after release")
+	}
+}
+
+func TestConnLimiterQueueCancel(t *testing.T) {
+	l := newConnLimiter(Limits{MaxConnections: 1, Queue: true})
+	if _, err := l.reserve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := l.reserve(ctx)
+		errs <- err
+	}()
+	select {
+	case <-errs:
+		t.Fatal("reserved over MaxConnections")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reserve still waiting after cancel")
+	}
+
+	// The cancelled wait took no slot.
+	l.unreserve(true)
+	if _, err := l.admit(nil, false); err != nil {
+		t.Fatalf("slot taken by a cancelled wait: %v", err)
+	}
+}
+
+func TestConnLimiterRateCancel(t *testing.T) {
+	l := newConnLimiter(Limits{AcceptRate: 0.1, AcceptBurst: 1, Queue: true})
+	if _, err := l.reserve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := l.reserve(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("rate wait not cancelled, took %v", elapsed)
+	}
+}
+
+func TestTcpTunnelManagerStopQueued(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+	}()
+
+	manager := NewTcpTunnelMangerAddr(listener, backend.Addr().(*net.TCPAddr))
+	manager.(LimitsSetter).SetLimits(Limits{MaxConnections: 1, Queue: true})
+	done := make(chan struct{})
+	go func() {
+		manager.StartForwarding()
+		close(done)
+	}()
+
+	// The visitor takes the only slot, the accept loop waits for it.
+	visitor, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.Stats().Active) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("visitor not forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	manager.(Stopper).Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop still waiting after Stop")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	if !b.allow(1) || !b.allow(1) || b.allow(1) {
+		t.Fatal("burst not enforced")
+	}
+	if wait := b.reserve(1); wait < 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Fatalf("unexpected wait %v", wait)
+	}
+}
@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/proxyproto"
+)
+
+type proxyHeaderDialer struct {
+	TcpDialer
+	version proxyproto.Version
+}
+
+/*
+NewProxyHeaderDialer wraps dialer so that every forwarded connection starts
+with a PROXY protocol header of the given version, carrying the address of
+the visitor.
+*/
+func NewProxyHeaderDialer(dialer TcpDialer, version proxyproto.Version) TcpDialer {
+	return &proxyHeaderDialer{TcpDialer: dialer, version: version}
+}
+
+func (d *proxyHeaderDialer) DialFrom(src, dst net.Addr) (net.Conn, error) {
+	conn, err := d.TcpDialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := proxyproto.NewHeader(d.version, src, dst).WriteTo(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+Close stops the wrapped dialer, if it can be closed, e.g. the health checks
+of a balancer.
+*/
+func (d *proxyHeaderDialer) Close() error {
+	if closer, ok := d.TcpDialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+tokenBucket refills rate tokens per second, holding at most burst of them.
+Reservations may take the bucket below zero; the caller then waits for the
+returned duration, so that waiting callers are served in order. A rate of
+zero means unlimited.
+*/
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setRate(rate, burst)
+	return b
+}
+
+/*
+defaultBurst allows one second worth of tokens, at least one.
+*/
+func defaultBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// refill expects b.mu to be held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) setRate(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	wasUnlimited := b.rate <= 0
+	b.rate = rate
+	b.burst = float64(burst)
+	if burst <= 0 {
+		b.burst = defaultBurst(rate)
+	}
+	if wasUnlimited || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+/*
+allow takes n tokens if they are available.
+*/
+func (b *tokenBucket) allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+/*
+reserve takes n tokens and returns how long to wait until they are covered.
+*/
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,302 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Why a forwarded connection ended.
+*/
+type CloseReason string
+
+const (
+	/*
+		The visitor closed the connection.
+	*/
+	CloseVisitor CloseReason = "visitor"
+
+	/*
+		The backend closed the connection.
+	*/
+	CloseBackend CloseReason = "backend"
+
+	/*
+		The connection was closed locally, e.g. by Drain or by closing the tunnel.
+	*/
+	CloseLocal CloseReason = "local"
+
+	/*
+		The backend could not be reached.
+	*/
+	CloseDialFailed CloseReason = "dial failed"
+
+	/*
+		Reading or writing failed, see ConnMetrics.Err.
+	*/
+	CloseError CloseReason = "error"
+)
+
+/*
+Number of closed connections kept in ForwardingStats.Recent.
+*/
+const MaxRecentConns = 100
+
+/*
+Metrics of a single forwarded tcp connection or udp session.
+*/
+type ConnMetrics struct {
+	Id          uint64
+	RemoteAddr  string
+	BackendAddr string
+
+	/*
+		Bytes and packets forwarded from the visitor to the backend (in) and back
+		(out). For tcp, a packet is a chunk of data read at once.
+	*/
+	BytesIn    int64
+	BytesOut   int64
+	PacketsIn  int64
+	PacketsOut int64
+
+	Start time.Time
+
+	/*
+		Zero while the connection is active.
+	*/
+	End time.Time
+
+	/*
+		Time taken to connect to the backend.
+	*/
+	DialLatency time.Duration
+
+	/*
+		Empty while the connection is active.
+	*/
+	CloseReason CloseReason
+	Err         error
+}
+
+/*
+Snapshot of the forwarding done by a TunnelManager.
+*/
+type ForwardingStats struct {
+	/*
+		Number of connections handled so far, and how many of them failed to
+		reach the backend.
+	*/
+	Connections  int64
+	DialFailures int64
+
+	/*
+		Connections refused by the Limits of the manager, not counted in
+		Connections.
+	*/
+	Rejected int64
+
+	/*
+		Bytes forwarded by every connection, active or closed.
+	*/
+	BytesIn  int64
+	BytesOut int64
+
+	Active []ConnMetrics
+
+	/*
+		The most recently closed connections, oldest first. At most MaxRecentConns.
+	*/
+	Recent []ConnMetrics
+}
+
+/*
+Add merges other into s.
+*/
+func (s *ForwardingStats) Add(other ForwardingStats) {
+	s.Connections += other.Connections
+	s.DialFailures += other.DialFailures
+	s.Rejected += other.Rejected
+	s.BytesIn += other.BytesIn
+	s.BytesOut += other.BytesOut
+	s.Active = append(s.Active, other.Active...)
+	s.Recent = append(s.Recent, other.Recent...)
+}
+
+type connMetrics struct {
+	// Accessed atomically, kept first for alignment.
+	bytesIn    int64
+	bytesOut   int64
+	packetsIn  int64
+	packetsOut int64
+
+	mu   sync.Mutex
+	info ConnMetrics
+}
+
+func (m *connMetrics) countIn(n int) {
+	atomic.AddInt64(&m.bytesIn, int64(n))
+	atomic.AddInt64(&m.packetsIn, 1)
+}
+
+func (m *connMetrics) countOut(n int) {
+	atomic.AddInt64(&m.bytesOut, int64(n))
+	atomic.AddInt64(&m.packetsOut, 1)
+}
+
+/*
+ended records why the connection ended, unless a reason is known already.
+side is the reason to use when reading stopped without an error.
+*/
+func (m *connMetrics) ended(side CloseReason, err error) {
+	reason := side
+	if err != nil && err != io.EOF {
+		if errors.Is(err, net.ErrClosed) {
+			reason, err = CloseLocal, nil
+		} else {
+			reason = CloseError
+		}
+	} else {
+		err = nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.info.CloseReason == "" {
+		m.info.CloseReason = reason
+		m.info.Err = err
+	}
+}
+
+func (m *connMetrics) snapshot() ConnMetrics {
+	m.mu.Lock()
+	info := m.info
+	m.mu.Unlock()
+	info.BytesIn = atomic.LoadInt64(&m.bytesIn)
+	info.BytesOut = atomic.LoadInt64(&m.bytesOut)
+	info.PacketsIn = atomic.LoadInt64(&m.packetsIn)
+	info.PacketsOut = atomic.LoadInt64(&m.packetsOut)
+	return info
+}
+
+type countingWriter struct {
+	io.Writer
+	count func(int)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if n > 0 {
+		w.count(n)
+	}
+	return n, err
+}
+
+/*
+statsRecorder keeps the metrics of the active connections of a tunnel
+manager and of the last closed ones.
+*/
+type statsRecorder struct {
+	mu           sync.Mutex
+	nextId       uint64
+	active       map[*connMetrics]struct{}
+	recent       []ConnMetrics
+	connections  int64
+	dialFailures int64
+	rejections   int64
+	closedIn     int64
+	closedOut    int64
+}
+
+func newStatsRecorder() *statsRecorder {
+	return &statsRecorder{active: make(map[*connMetrics]struct{})}
+}
+
+func (r *statsRecorder) open(remoteAddr net.Addr) *connMetrics {
+	m := &connMetrics{info: ConnMetrics{Start: time.Now()}}
+	if remoteAddr != nil {
+		m.info.RemoteAddr = remoteAddr.String()
+	}
+	r.mu.Lock()
+	r.nextId += 1
+	m.info.Id = r.nextId
+	r.connections += 1
+	r.active[m] = struct{}{}
+	r.mu.Unlock()
+	return m
+}
+
+func (r *statsRecorder) dialed(m *connMetrics, backendAddr net.Addr, start time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.info.DialLatency = time.Since(start)
+	if backendAddr != nil {
+		m.info.BackendAddr = backendAddr.String()
+	}
+}
+
+func (r *statsRecorder) dialFailed(m *connMetrics, backendAddr net.Addr, err error) {
+	m.mu.Lock()
+	m.info.CloseReason = CloseDialFailed
+	m.info.Err = err
+	if backendAddr != nil {
+		m.info.BackendAddr = backendAddr.String()
+	}
+	m.mu.Unlock()
+	r.mu.Lock()
+	r.dialFailures += 1
+	r.mu.Unlock()
+	r.finish(m)
+}
+
+func (r *statsRecorder) rejected() {
+	r.mu.Lock()
+	r.rejections += 1
+	r.mu.Unlock()
+}
+
+func (r *statsRecorder) finish(m *connMetrics) {
+	m.mu.Lock()
+	m.info.End = time.Now()
+	if m.info.CloseReason == "" {
+		m.info.CloseReason = CloseLocal
+	}
+	m.mu.Unlock()
+	info := m.snapshot()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, m)
+	r.closedIn += info.BytesIn
+	r.closedOut += info.BytesOut
+	if len(r.recent) == MaxRecentConns {
+		copy(r.recent, r.recent[1:])
+		r.recent = r.recent[:MaxRecentConns-1]
+	}
+	r.recent = append(r.recent, info)
+}
+
+func (r *statsRecorder) snapshot() ForwardingStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := ForwardingStats{
+		Connections:  r.connections,
+		DialFailures: r.dialFailures,
+		Rejected:     r.rejections,
+		BytesIn:      r.closedIn,
+		BytesOut:     r.closedOut,
+		Active:       make([]ConnMetrics, 0, len(r.active)),
+		Recent:       append([]ConnMetrics{}, r.recent...),
+	}
+	for m := range r.active {
+		info := m.snapshot()
+		stats.BytesIn += info.BytesIn
+		stats.BytesOut += info.BytesOut
+		stats.Active = append(stats.Active, info)
+	}
+	sort.Slice(stats.Active, func(i, j int) bool { return stats.Active[i].Id < stats.Active[j].Id })
+	return stats
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpTunnelManagerStats(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+		conn.Write([]byte("pong"))
+		conn.Close()
+	}()
+
+	visitors, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitors.Close()
+	man, err := NewTcpTunnelManger(visitors, backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go man.StartForwarding()
+
+	visitor, err := net.Dial("tcp", visitors.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor.Write([]byte("ping!"))
+	reply, _ := io.ReadAll(visitor)
+	visitor.Close()
+	if string(reply) != "pong" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(man.Stats().Recent) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := man.Stats()
+	conn := stats.Recent[0]
+	if stats.Connections != 1 || len(stats.Active) != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if conn.BytesIn != 5 || conn.BytesOut != 4 || stats.BytesIn != 5 || stats.BytesOut != 4 {
+		t.Fatalf("unexpected byte counts %+v", conn)
+	}
+	if conn.CloseReason != CloseBackend || conn.BackendAddr != backend.Addr().String() || conn.End.Before(conn.Start) {
+		t.Fatalf("unexpected metrics %+v", conn)
+	}
+}
@@ -1,9 +1,13 @@
 package tunnel
 
 import (
+	"context"
 	"io"
-	"log"
 	"net"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
 )
 
 type TcpDialer interface {
@@ -11,6 +15,15 @@ type TcpDialer interface {
 	Dial() (net.Conn, error)
 }
 
+/*
+TcpDialerFrom is implemented by dialers which need the addresses of the
+visitor connection, src being the visitor. The tunnel managers prefer
+DialFrom over Dial.
+*/
+type TcpDialerFrom interface {
+	DialFrom(src, dst net.Addr) (net.Conn, error)
+}
+
 type tcpDialer struct {
 	addr *net.TCPAddr
 }
@@ -18,6 +31,16 @@ type tcpDialer struct {
 type tcpTunnelManager struct {
 	dialer       TcpDialer
 	connListener net.Listener
+	logger       logging.Logger
+	tracker      *ConnTracker
+	stats        *statsRecorder
+	limiter      *connLimiter
+	shaper       *BandwidthShaper
+	bus          *events.Bus
+
+	// Done once the manager is stopped.
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 func (t *tcpDialer) Dial() (net.Conn, error) {
@@ -28,21 +51,41 @@ func (t *tcpDialer) GetAddr() net.Addr {
 	return t.addr
 }
 
-func (t *tcpTunnelManager) copy(dst, src net.Conn) {
+func (t *tcpTunnelManager) copy(dst, src net.Conn, count func(int), metrics *connMetrics, side CloseReason) {
 	defer src.Close()
 	defer dst.Close()
-	io.Copy(dst, src)
+	_, err := io.Copy(&countingWriter{Writer: dst, count: count}, src)
+	metrics.ended(side, err)
 }
 
 func (t *tcpTunnelManager) StartTunnel(streamConn net.Conn) {
-	conn, err := t.dialer.Dial()
+	metrics := t.stats.open(streamConn.RemoteAddr())
+	streamConn = t.shaper.Conn(t.tracker.Track(streamConn))
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if dialer, ok := t.dialer.(TcpDialerFrom); ok {
+		conn, err = dialer.DialFrom(streamConn.RemoteAddr(), streamConn.LocalAddr())
+	} else {
+		conn, err = t.dialer.Dial()
+	}
 	if err != nil {
+		t.logger.Error("could not connect to forwarding address", "addr", t.dialer.GetAddr().String(), "err", err)
+		t.bus.Publish(events.Event{Type: events.DialFailed, Addr: t.dialer.GetAddr().String(), Err: err})
 		streamConn.Close()
-		log.Println("Error: could not connect to ", t.dialer.GetAddr().String())
+		t.stats.dialFailed(metrics, t.dialer.GetAddr(), err)
 		return
 	}
-	go t.copy(streamConn, conn)
-	t.copy(conn, streamConn)
+	t.stats.dialed(metrics, conn.RemoteAddr(), start)
+
+	done := make(chan struct{})
+	go func() {
+		t.copy(streamConn, conn, metrics.countOut, metrics, CloseBackend)
+		close(done)
+	}()
+	t.copy(conn, streamConn, metrics.countIn, metrics, CloseVisitor)
+	<-done
+	t.stats.finish(metrics)
 }
 
 func (t *tcpDialer) UpdateAddr(addr net.Addr) {
@@ -61,11 +104,28 @@ func NewTcpDialer(tcpAddr *net.TCPAddr) TcpDialer {
 }
 
 func (t *tcpTunnelManager) AcceptAndForward() error {
+	if t.ctx.Err() != nil {
+		return net.ErrClosed
+	}
+	reserved, err := t.limiter.reserve(t.ctx)
+	if err != nil {
+		// Stopped while waiting for a free slot.
+		return net.ErrClosed
+	}
 	conn, err := t.connListener.Accept()
 	if err != nil {
+		t.limiter.unreserve(reserved)
 		return err
 	}
-	go t.StartTunnel(conn)
+	release, err := t.limiter.admit(conn.RemoteAddr(), reserved)
+	if err != nil {
+		rejectConn(conn, err, t.logger, t.bus, t.stats)
+		return nil
+	}
+	go func() {
+		defer release()
+		t.StartTunnel(conn)
+	}()
 	return nil
 }
 
@@ -73,7 +133,7 @@ func (t *tcpTunnelManager) StartForwarding() {
 	for {
 		err := t.AcceptAndForward()
 		if err != nil {
-			log.Println("Error: could not Accept and forward ", t.dialer.GetAddr().String())
+			t.logger.Warn("could not accept and forward", "addr", t.dialer.GetAddr().String(), "err", err)
 			break
 		}
 	}
@@ -83,12 +143,52 @@ func (t *tcpTunnelManager) GetDialer() Dialer {
 	return t.dialer
 }
 
+func (t *tcpTunnelManager) SetLogger(logger logging.Logger) {
+	t.logger = logging.OrNop(logger)
+}
+
+func (t *tcpTunnelManager) SetEventBus(bus *events.Bus) {
+	t.bus = bus
+	t.tracker.SetHooks(func(conn net.Conn) {
+		bus.Publish(events.Event{Type: events.VisitorOpened, RemoteAddr: conn.RemoteAddr()})
+	}, func(conn net.Conn, stats ConnStats) {
+		bus.Publish(events.Event{
+			Type:       events.VisitorClosed,
+			RemoteAddr: conn.RemoteAddr(),
+			BytesIn:    stats.BytesIn,
+			BytesOut:   stats.BytesOut,
+			Duration:   stats.Duration,
+		})
+	})
+}
+
+func (t *tcpTunnelManager) SetLimits(limits Limits) {
+	t.limiter = newConnLimiter(limits)
+}
+
+func (t *tcpTunnelManager) SetBandwidthShaper(shaper *BandwidthShaper) {
+	t.shaper = shaper
+}
+
+func (t *tcpTunnelManager) Stats() ForwardingStats {
+	return t.stats.snapshot()
+}
+
+func (t *tcpTunnelManager) Drain(ctx context.Context) (int, error) {
+	return t.tracker.Drain(ctx)
+}
+
+func (t *tcpTunnelManager) Stop() {
+	t.stop()
+}
+
 func NewTcpTunnelMangerDialer(listener net.Listener, dialer TcpDialer) TunnelManager {
-	return &tcpTunnelManager{connListener: listener, dialer: dialer}
+	ctx, stop := context.WithCancel(context.Background())
+	return &tcpTunnelManager{connListener: listener, dialer: dialer, logger: logging.Nop(), tracker: NewConnTracker(), stats: newStatsRecorder(), ctx: ctx, stop: stop}
 }
 
 func NewTcpTunnelMangerAddr(listener net.Listener, forwardAddr *net.TCPAddr) TunnelManager {
-	return &tcpTunnelManager{connListener: listener, dialer: NewTcpDialer(forwardAddr)}
+	return NewTcpTunnelMangerDialer(listener, NewTcpDialer(forwardAddr))
 }
 
 func NewTcpTunnelManger(listener net.Listener, forwardAddr string) (TunnelManager, error) {
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ConnTracker keeps track of active connections, so that they can be drained
+or closed together.
+*/
+type ConnTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+
+	onOpen  func(net.Conn)
+	onClose func(net.Conn, ConnStats)
+}
+
+/*
+Traffic of a tracked connection.
+*/
+type ConnStats struct {
+	/*
+		Bytes read from and written to the connection.
+	*/
+	BytesIn  int64
+	BytesOut int64
+
+	Duration time.Duration
+}
+
+type trackedConn struct {
+	// Accessed atomically, kept first for alignment.
+	bytesIn  int64
+	bytesOut int64
+
+	net.Conn
+	tracker *ConnTracker
+	start   time.Time
+	once    sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.tracker.remove(c)
+		if c.tracker.onClose != nil {
+			c.tracker.onClose(c.Conn, ConnStats{
+				BytesIn:  atomic.LoadInt64(&c.bytesIn),
+				BytesOut: atomic.LoadInt64(&c.bytesOut),
+				Duration: time.Since(c.start),
+			})
+		}
+	})
+	return err
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *ConnTracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.tracker.Track(conn), nil
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+/*
+SetHooks registers functions called when a connection starts being tracked
+and once it is closed. It has to be called before tracking any connection.
+*/
+func (t *ConnTracker) SetHooks(onOpen func(net.Conn), onClose func(net.Conn, ConnStats)) {
+	t.onOpen = onOpen
+	t.onClose = onClose
+}
+
+/*
+Track registers conn until the returned connection gets closed.
+*/
+func (t *ConnTracker) Track(conn net.Conn) net.Conn {
+	tc := &trackedConn{Conn: conn, tracker: t, start: time.Now()}
+	t.mu.Lock()
+	t.conns[tc] = struct{}{}
+	t.mu.Unlock()
+	if t.onOpen != nil {
+		t.onOpen(conn)
+	}
+	return tc
+}
+
+/*
+Listener wraps l so that every accepted connection is tracked.
+*/
+func (t *ConnTracker) Listener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l, tracker: t}
+}
+
+func (t *ConnTracker) remove(tc *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, tc)
+	t.mu.Unlock()
+}
+
+/*
+Len returns the number of active connections.
+*/
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+/*
+CloseAll closes every active connection and returns how many were closed.
+*/
+func (t *ConnTracker) CloseAll() int {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for tc := range t.conns {
+		conns = append(conns, tc)
+	}
+	t.mu.Unlock()
+
+	for _, tc := range conns {
+		tc.Close()
+	}
+	return len(conns)
+}
+
+const drainPollInterval = 50 * time.Millisecond
+
+/*
+Drain waits until every connection is closed. If ctx is done first, the
+remaining connections are closed; their number is returned along with the
+context error.
+*/
+func (t *ConnTracker) Drain(ctx context.Context) (int, error) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if t.Len() == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return t.CloseAll(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
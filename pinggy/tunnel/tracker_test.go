@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+fakeConn is a connection which records being closed.
+*/
+type fakeConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	closes int
+}
+
+func newFakeConn(t *testing.T) *fakeConn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	return &fakeConn{Conn: local}
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	c.closes++
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *fakeConn) closeCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closes
+}
+
+func TestConnTrackerDrain(t *testing.T) {
+	tracker := NewConnTracker()
+	a := tracker.Track(newFakeConn(t))
+	b := tracker.Track(newFakeConn(t))
+	if n := tracker.Len(); n != 2 {
+		t.Fatalf("expected 2 connections, got %d", n)
+	}
+
+	go func() {
+		a.Close()
+		time.Sleep(2 * drainPollInterval)
+		b.Close()
+	}()
+	start := time.Now()
+	n, err := tracker.Drain(context.Background())
+	if n != 0 || err != nil {
+		t.Fatalf("expected a clean drain, got %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*drainPollInterval {
+		t.Fatalf("drain returned before the connections were closed, after %v", elapsed)
+	}
+	if n := tracker.Len(); n != 0 {
+		t.Fatalf("expected no connections, got %d", n)
+	}
+}
+
+func TestConnTrackerDrainDeadline(t *testing.T) {
+	tracker := NewConnTracker()
+	closed := newFakeConn(t)
+	tracker.Track(closed).Close()
+	busy := []*fakeConn{newFakeConn(t), newFakeConn(t)}
+	for _, conn := range busy {
+		tracker.Track(conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*drainPollInterval)
+	defer cancel()
+	n, err := tracker.Drain(ctx)
+	if n != len(busy) || err != context.DeadlineExceeded {
+		t.Fatalf("expected %d force closed connections, got %d, %v", len(busy), n, err)
+	}
+	for i, conn := range busy {
+		if closes := conn.closeCount(); closes != 1 {
+			t.Fatalf("connection %d closed %d times", i, closes)
+		}
+	}
+	if closes := closed.closeCount(); closes != 1 {
+		t.Fatalf("closed connection closed %d times", closes)
+	}
+	if n := tracker.Len(); n != 0 {
+		t.Fatalf("expected no connections, got %d", n)
+	}
+}
+
+func TestConnTrackerCloseConcurrent(t *testing.T) {
+	tracker := NewConnTracker()
+	closedHook := 0
+	var mu sync.Mutex
+	tracker.SetHooks(nil, func(net.Conn, ConnStats) {
+		mu.Lock()
+		closedHook++
+		mu.Unlock()
+	})
+	conns := make([]*fakeConn, 8)
+	tracked := make([]net.Conn, len(conns))
+	for i := range conns {
+		conns[i] = newFakeConn(t)
+		tracked[i] = tracker.Track(conns[i])
+	}
+
+	// Connections closing on their own while the tracker closes all of them
+	// are reported once.
+	var wg sync.WaitGroup
+	for _, conn := range tracked {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			conn.Close()
+		}(conn)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.Drain(ctx)
+	wg.Wait()
+
+	if n := tracker.Len(); n != 0 {
+		t.Fatalf("expected no connections, got %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if closedHook != len(conns) {
+		t.Fatalf("expected %d close hooks, got %d", len(conns), closedHook)
+	}
+}
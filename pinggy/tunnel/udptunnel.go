@@ -1,11 +1,15 @@
 package tunnel
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"time"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/events"
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
 )
 
 type UdpDialer interface {
@@ -16,6 +20,8 @@ type udpTunnel struct {
 	packetConn *net.UDPConn
 	streamConn net.Conn
 	toAddr     net.Addr
+	logger     logging.Logger
+	metrics    *connMetrics
 }
 
 func (c *udpTunnel) close() {
@@ -29,20 +35,24 @@ func (c *udpTunnel) copyToTcp() {
 	for {
 		n, _, err := c.packetConn.ReadFrom(buffer)
 		if err != nil {
+			c.metrics.ended(CloseBackend, err)
 			break
 		}
 		if n <= 0 {
+			c.metrics.ended(CloseBackend, nil)
 			break
 		}
 		lengthBytes := make([]byte, 2)
 		binary.BigEndian.PutUint16(lengthBytes, uint16(n))
 		packet := append(lengthBytes, buffer[:n]...)
-		fmt.Println("Writing ", n+2, "bytes to TCP")
+		c.logger.Debug("writing packet to tcp", "bytes", n+2)
 		_, err = c.streamConn.Write(packet)
 		if err != nil {
-			log.Println("Error while writing packet to tcp, ", err)
+			c.logger.Warn("error while writing packet to tcp", "err", err)
+			c.metrics.ended(CloseVisitor, err)
 			break
 		}
+		c.metrics.countOut(n)
 	}
 }
 
@@ -53,6 +63,7 @@ func (c *udpTunnel) copyToUdp() {
 		// Read the length of the UDP packet
 		_, err := io.ReadFull(c.streamConn, buffer[:2])
 		if err != nil {
+			c.metrics.ended(CloseVisitor, err)
 			break
 		}
 
@@ -62,17 +73,20 @@ func (c *udpTunnel) copyToUdp() {
 		// Read the rest of the UDP packet
 		_, err = io.ReadFull(c.streamConn, buffer[:length])
 		if err != nil {
+			c.metrics.ended(CloseVisitor, err)
 			break
 		}
 
-		fmt.Println("Writing ", length, "bytes to UDP", c.toAddr.String())
+		c.logger.Debug("writing packet to udp", "bytes", length, "addr", c.toAddr.String())
 
 		// Write the data to the TCP connection
 		_, err = c.packetConn.Write(buffer[:length])
 		if err != nil {
-			log.Println("Error while writing packet to udp, ", err)
+			c.logger.Warn("error while writing packet to udp", "err", err)
+			c.metrics.ended(CloseBackend, err)
 			break
 		}
+		c.metrics.countIn(int(length))
 	}
 }
 
@@ -102,27 +116,67 @@ func (u *udpDialer) UpdateAddr(addr net.Addr) {
 type udpTunnelManager struct {
 	dialer       UdpDialer
 	connListener net.Listener
+	logger       logging.Logger
+	tracker      *ConnTracker
+	stats        *statsRecorder
+	limiter      *connLimiter
+	shaper       *BandwidthShaper
+	bus          *events.Bus
+
+	// Done once the manager is stopped.
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 func (t *udpTunnelManager) StartTunnel(streamConn net.Conn) {
+	metrics := t.stats.open(streamConn.RemoteAddr())
+	streamConn = t.shaper.Conn(t.tracker.Track(streamConn))
+	start := time.Now()
 	packetConn, err := t.dialer.Dial()
 	if err != nil {
+		t.logger.Error("could not connect to forwarding address", "addr", t.dialer.GetAddr().String(), "err", err)
+		t.bus.Publish(events.Event{Type: events.DialFailed, Addr: t.dialer.GetAddr().String(), Err: err})
 		streamConn.Close()
+		t.stats.dialFailed(metrics, t.dialer.GetAddr(), err)
 		return
 	}
-	tun := udpTunnel{packetConn: packetConn, streamConn: streamConn, toAddr: t.dialer.GetAddr()}
-	fmt.Println("Fowarding new con")
-	go tun.copyToTcp()
+	t.stats.dialed(metrics, packetConn.RemoteAddr(), start)
+	tun := udpTunnel{packetConn: packetConn, streamConn: streamConn, toAddr: t.dialer.GetAddr(), logger: t.logger, metrics: metrics}
+	t.logger.Debug("forwarding new udp session", "addr", t.dialer.GetAddr().String())
+
+	done := make(chan struct{})
+	go func() {
+		tun.copyToTcp()
+		close(done)
+	}()
 	tun.copyToUdp()
+	<-done
+	t.stats.finish(metrics)
 }
 
 func (t *udpTunnelManager) AcceptAndForward() error {
+	if t.ctx.Err() != nil {
+		return net.ErrClosed
+	}
+	reserved, err := t.limiter.reserve(t.ctx)
+	if err != nil {
+		// Stopped while waiting for a free slot.
+		return net.ErrClosed
+	}
 	conn, err := t.connListener.Accept()
 	if err != nil {
+		t.limiter.unreserve(reserved)
 		return err
 	}
-
-	go t.StartTunnel(conn)
+	release, err := t.limiter.admit(conn.RemoteAddr(), reserved)
+	if err != nil {
+		rejectConn(conn, err, t.logger, t.bus, t.stats)
+		return nil
+	}
+	go func() {
+		defer release()
+		t.StartTunnel(conn)
+	}()
 	return nil
 }
 
@@ -139,12 +193,52 @@ func (u *udpTunnelManager) GetDialer() Dialer {
 	return u.dialer
 }
 
+func (u *udpTunnelManager) SetLogger(logger logging.Logger) {
+	u.logger = logging.OrNop(logger)
+}
+
+func (u *udpTunnelManager) SetEventBus(bus *events.Bus) {
+	u.bus = bus
+	u.tracker.SetHooks(func(conn net.Conn) {
+		bus.Publish(events.Event{Type: events.UdpSessionCreated, RemoteAddr: conn.RemoteAddr()})
+	}, func(conn net.Conn, stats ConnStats) {
+		bus.Publish(events.Event{
+			Type:       events.UdpSessionExpired,
+			RemoteAddr: conn.RemoteAddr(),
+			BytesIn:    stats.BytesIn,
+			BytesOut:   stats.BytesOut,
+			Duration:   stats.Duration,
+		})
+	})
+}
+
+func (u *udpTunnelManager) SetLimits(limits Limits) {
+	u.limiter = newConnLimiter(limits)
+}
+
+func (u *udpTunnelManager) SetBandwidthShaper(shaper *BandwidthShaper) {
+	u.shaper = shaper
+}
+
+func (u *udpTunnelManager) Stats() ForwardingStats {
+	return u.stats.snapshot()
+}
+
+func (u *udpTunnelManager) Drain(ctx context.Context) (int, error) {
+	return u.tracker.Drain(ctx)
+}
+
+func (u *udpTunnelManager) Stop() {
+	u.stop()
+}
+
 func NewUdpDialer(forwardAddr *net.UDPAddr) UdpDialer {
 	return &udpDialer{udpAddr: forwardAddr}
 }
 
 func NewUdpTunnelMangerWithDialer(listener net.Listener, dialer UdpDialer) TunnelManager {
-	tunMan := &udpTunnelManager{connListener: listener, dialer: dialer}
+	ctx, stop := context.WithCancel(context.Background())
+	tunMan := &udpTunnelManager{connListener: listener, dialer: dialer, logger: logging.Nop(), tracker: NewConnTracker(), stats: newStatsRecorder(), ctx: ctx, stop: stop}
 	return tunMan
 }
 
@@ -169,6 +263,5 @@ func NewUdpTunnelMangerListen(listeningPort int, forwardAddr string) (TunnelMana
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("Listening: ", listeningPort)
 	return NewUdpTunnelMangerAddr(listener, udpAddr), nil
 }
@@ -2,10 +2,11 @@ package pinggy
 
 import (
 	"encoding/binary"
-	"fmt"
 	"io"
-	"log"
 	"net"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/logging"
+	"github.com/Pinggy-io/pinggy-go/pinggy/tunnel"
 )
 
 type packet struct {
@@ -29,6 +30,9 @@ type packetForwardingHandler struct {
 	port        uint16
 	readChannel chan *packet
 	tunnels     map[string]udpTunnel
+	logger      logging.Logger
+	tracker     *tunnel.ConnTracker
+	shaper      *tunnel.BandwidthShaper
 }
 
 func (t *udpTunnel) close() {
@@ -44,20 +48,20 @@ func (t *udpTunnel) copyToTcp() {
 		case buffer := <-t.writeChannel:
 			n := len(buffer)
 			if n <= 0 {
-				log.Println("Error")
+				t.pfh.logger.Warn("empty udp packet")
 				return
 			}
 			lengthBytes := make([]byte, 2)
 			binary.BigEndian.PutUint16(lengthBytes, uint16(n))
 			packet := append(lengthBytes, buffer[:n]...)
-			fmt.Println("Writing ", n+2, "bytes to TCP")
+			t.pfh.logger.Debug("writing packet to tcp", "bytes", n+2)
 			_, err := t.conn.Write(packet)
 			if err != nil {
-				log.Println("Error")
+				t.pfh.logger.Warn("error while writing packet to tcp", "err", err)
 				return
 			}
 		case <-t.closeChannel:
-			log.Println("Closed")
+			t.pfh.logger.Debug("udp tunnel closed", "addr", t.addr)
 			return
 		}
 	}
@@ -69,7 +73,7 @@ func (t *udpTunnel) copyToUdp() {
 	for {
 		_, err := io.ReadFull(t.conn, buffer[:2])
 		if err != nil {
-			log.Println("Error")
+			t.pfh.logger.Debug("error while reading packet length", "err", err)
 			return
 		}
 
@@ -79,11 +83,11 @@ func (t *udpTunnel) copyToUdp() {
 		// Read the rest of the UDP packet
 		_, err = io.ReadFull(t.conn, buffer[:length])
 		if err != nil {
-			log.Println("Error")
+			t.pfh.logger.Warn("error while reading packet", "err", err)
 			return
 		}
 
-		fmt.Println("Writing ", length, "bytes to UDP")
+		t.pfh.logger.Debug("writing packet to udp", "bytes", length)
 
 		if t.closed {
 			return
@@ -99,7 +103,7 @@ func (pfh *packetForwardingHandler) startTunnel(conn net.Conn) {
 		pfh.port += 1
 	}
 	tun := udpTunnel{
-		conn:         conn,
+		conn:         pfh.shaper.Conn(pfh.tracker.Track(conn)),
 		addr:         &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(pfh.port)}, //FIXME
 		pfh:          pfh,
 		writeChannel: make(chan []byte, 20),
@@ -107,17 +111,17 @@ func (pfh *packetForwardingHandler) startTunnel(conn net.Conn) {
 		closed:       false,
 	}
 	pfh.tunnels[tun.addr.String()] = tun
-	log.Println("Starting tunnel")
+	pfh.logger.Debug("starting udp tunnel", "addr", tun.addr)
 	go tun.copyToTcp()
 	tun.copyToUdp()
 }
 
 func (pfh *packetForwardingHandler) startForwarding() error {
-	log.Println("starting forwarding")
+	pfh.logger.Debug("starting udp forwarding")
 	for {
 		conn, err := pfh.list.Accept()
 		if err != nil {
-			log.Println("Error occured")
+			pfh.logger.Warn("udp forwarding stopped", "err", err)
 			pfh.readChannel <- &packet{nil, nil, true}
 			return err
 		}
@@ -0,0 +1,140 @@
+package pinggy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/Pinggy-io/pinggy-go/pinggy/control"
+	"github.com/Pinggy-io/pinggy-go/pinggy/webauth"
+)
+
+/*
+Default address of the web debugger. It is reachable from this machine only.
+*/
+const DefaultWebDebuggerAddr = "localhost:4300"
+
+const webDebuggerTokenCookie = "pinggy_debugger_token"
+
+type WebDebuggerConfig struct {
+	/*
+		Address to listen at. Default `localhost:4300`. Use e.g. `0.0.0.0:4300`
+		to expose the debugger to other machines, preferably with authentication.
+	*/
+	Addr string
+
+	/*
+		Require basic authentication with these credentials. Both have to be set.
+	*/
+	Username string
+	Password string
+
+	/*
+		Require this token, passed either as `Authorization: Bearer <token>` or
+		once as `?token=<token>` query parameter, which is then kept in a cookie.
+	*/
+	Token string
+}
+
+/*
+A running web debugger.
+*/
+type WebDebugger struct {
+	listener net.Listener
+	server   *http.Server
+	pl       *pinggyListener
+	once     sync.Once
+}
+
+func (wd *WebDebugger) Addr() net.Addr {
+	return wd.listener.Addr()
+}
+
+/*
+Close stops the debugger and closes its connections.
+*/
+func (wd *WebDebugger) Close() error {
+	var err error
+	wd.once.Do(func() {
+		wd.pl.mu.Lock()
+		delete(wd.pl.debuggers, wd)
+		wd.pl.mu.Unlock()
+		err = wd.server.Close()
+	})
+	return err
+}
+
+func (pl *pinggyListener) StartWebDebugger(conf WebDebuggerConfig) (*WebDebugger, error) {
+	if pl.conf.Type != HTTP {
+		return nil, fmt.Errorf("webDebugging is available only with %v mode", HTTP)
+	}
+	auth := webauth.Config{
+		Username:   conf.Username,
+		Password:   conf.Password,
+		Token:      conf.Token,
+		Realm:      "pinggy web debugger",
+		CookieName: webDebuggerTokenCookie,
+	}
+	if err := auth.Verify(); err != nil {
+		return nil, err
+	}
+	if conf.Addr == "" {
+		conf.Addr = DefaultWebDebuggerAddr
+	}
+
+	pl.mu.Lock()
+	err := pl.startShell(pl.tunnel)
+	pl.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &url.URL{Scheme: "http", Host: control.Addr}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{
+		// Every request dials through the current ssh connection, a failure
+		// only affects that request.
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return pl.Dial()
+		},
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		pl.conf.log.Warn("web debugger request failed", "path", r.URL.Path, "err", err)
+		http.Error(w, "could not reach the web debugger", http.StatusBadGateway)
+	}
+
+	wd := &WebDebugger{listener: listener, pl: pl}
+	wd.server = &http.Server{Handler: auth.Handler(proxy)}
+
+	pl.mu.Lock()
+	if pl.isClosed() {
+		pl.mu.Unlock()
+		listener.Close()
+		return nil, net.ErrClosed
+	}
+	pl.debuggers[wd] = struct{}{}
+	pl.mu.Unlock()
+
+	go func() {
+		err := wd.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			pl.conf.log.Warn("web debugger stopped", "addr", listener.Addr(), "err", err)
+		}
+	}()
+	pl.conf.log.Info("web debugger started", "addr", listener.Addr())
+	return wd, nil
+}
+
+func (pl *pinggyListener) InitiateWebDebug(addr string) error {
+	_, err := pl.StartWebDebugger(WebDebuggerConfig{Addr: addr})
+	return err
+}
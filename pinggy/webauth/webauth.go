@@ -0,0 +1,124 @@
+/*
+Package webauth provides the optional basic or token authentication of the
+local web uis, the web debugger and the inspector, and the checks keeping
+other web sites from sending requests to them.
+*/
+package webauth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Config struct {
+	/*
+		Require basic authentication with these credentials. Both have to be set.
+	*/
+	Username string
+	Password string
+
+	/*
+		Require this token, passed either as `Authorization: Bearer <token>` or
+		once as `?token=<token>` query parameter, which is then kept in a cookie.
+	*/
+	Token string
+
+	/*
+		Name of the basic auth realm and of the token cookie.
+	*/
+	Realm      string
+	CookieName string
+}
+
+func (conf *Config) Verify() error {
+	if (conf.Username == "") != (conf.Password == "") {
+		return fmt.Errorf("both username and password are required for basic authentication")
+	}
+	return nil
+}
+
+/*
+Authorize checks the credentials of r and answers 401 if they do not match.
+The credentials are removed from r, so that they are not passed on.
+*/
+func (conf *Config) Authorize(w http.ResponseWriter, r *http.Request) bool {
+	if conf.Username != "" || conf.Password != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || !secureEqual(username, conf.Username) || !secureEqual(password, conf.Password) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", conf.Realm))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		r.Header.Del("Authorization")
+	}
+	if conf.Token != "" {
+		query := r.URL.Query()
+		token := query.Get("token")
+		if token != "" && secureEqual(token, conf.Token) {
+			http.SetCookie(w, &http.Cookie{Name: conf.CookieName, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+			// Do not pass the token on.
+			query.Del("token")
+			r.URL.RawQuery = query.Encode()
+			return true
+		}
+		if auth := r.Header.Get("Authorization"); len(auth) > 7 && auth[:7] == "Bearer " && secureEqual(auth[7:], conf.Token) {
+			r.Header.Del("Authorization")
+			return true
+		}
+		if cookie, err := r.Cookie(conf.CookieName); err == nil && secureEqual(cookie.Value, conf.Token) {
+			return true
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+/*
+Handler serves next to the requests passing Authorize.
+*/
+func (conf Config) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.Authorize(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+/*
+SameOrigin rejects with 403 the requests sent by another web site, i.e.
+with an Origin header not matching the Host. Requests without Origin, e.g.
+from curl, pass.
+*/
+func SameOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	http.Error(w, "cross origin requests are not allowed", http.StatusForbidden)
+	return false
+}
+
+/*
+JsonBody rejects with 415 the requests whose body is not declared as json.
+Web pages cannot send such requests to another site without its consent.
+*/
+func JsonBody(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mediaType == "application/json" {
+		return true
+	}
+	http.Error(w, "the request body must be application/json", http.StatusUnsupportedMediaType)
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,76 @@
+package webauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(conf Config, r *http.Request) (*httptest.ResponseRecorder, *http.Request) {
+	var forwarded *http.Request
+	handler := conf.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w, forwarded
+}
+
+func TestBasicAuth(t *testing.T) {
+	conf := Config{Username: "user", Password: "pass", Realm: "test"}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("user", "wrong")
+	if w, forwarded := serve(conf, r); w.Code != http.StatusUnauthorized || forwarded != nil {
+		t.Fatalf("wrong password passed with %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("user", "pass")
+	_, forwarded := serve(conf, r)
+	if forwarded == nil {
+		t.Fatal("request not forwarded")
+	}
+	if auth := forwarded.Header.Get("Authorization"); auth != "" {
+		t.Fatalf("credentials forwarded: %q", auth)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	conf := Config{Token: "secret", CookieName: "test_token"}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	_, forwarded := serve(conf, r)
+	if forwarded == nil {
+		t.Fatal("request not forwarded")
+	}
+	if auth := forwarded.Header.Get("Authorization"); auth != "" {
+		t.Fatalf("token forwarded: %q", auth)
+	}
+
+	r = httptest.NewRequest("GET", "/path?token=secret&a=b", nil)
+	w, forwarded := serve(conf, r)
+	if forwarded == nil {
+		t.Fatal("request not forwarded")
+	}
+	if forwarded.URL.RawQuery != "a=b" {
+		t.Fatalf("token forwarded: %q", forwarded.URL.RawQuery)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "test_token" {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	if _, forwarded := serve(conf, r); forwarded == nil {
+		t.Fatal("cookie not accepted")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	if w, forwarded := serve(conf, r); w.Code != http.StatusUnauthorized || forwarded != nil {
+		t.Fatalf("wrong token passed with %d", w.Code)
+	}
+}
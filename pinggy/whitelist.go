@@ -0,0 +1,135 @@
+package pinggy
+
+import (
+	"fmt"
+	"net"
+)
+
+/*
+whiteListArg renders an entry of the ip whitelist as a `w:` argument of the
+session command. The entry is sent as given, host bits included: `10.1.2.3/8`
+is sent as `w:10.1.2.3/8`, the server keeping the network only.
+*/
+func whiteListArg(ipNet *net.IPNet) string {
+	return "w:" + ipNet.String()
+}
+
+func whiteListCommand(whiteList []*net.IPNet) string {
+	command := ""
+	for _, ipNet := range whiteList {
+		command += " " + whiteListArg(ipNet)
+	}
+	return command
+}
+
+func verifyWhiteList(cerr *ConfigError, whiteList []*net.IPNet) {
+	for i, ipNet := range whiteList {
+		if ipNet == nil {
+			cerr.add(fmt.Sprintf("IpWhiteList[%d]", i), "entry is nil")
+		}
+	}
+}
+
+/*
+sameNetwork tells if a and b cover the same addresses, ignoring host bits:
+`10.1.2.3/8` and `10.0.0.0/8` are the same entry.
+*/
+func sameNetwork(a, b *net.IPNet) bool {
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	// Compare the host bits, as IPv4 networks may have IPv6 masks.
+	if aBits-aOnes != bBits-bOnes {
+		return false
+	}
+	return a.IP.Mask(a.Mask).Equal(b.IP.Mask(b.Mask))
+}
+
+func containsIpNet(whiteList []*net.IPNet, ipNet *net.IPNet) bool {
+	for _, entry := range whiteList {
+		if sameNetwork(entry, ipNet) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *pinggyListener) AddIpWhiteList(ipNets ...*net.IPNet) error {
+	return pl.updateIpWhiteList(ipNets, func(whiteList []*net.IPNet) []*net.IPNet {
+		for _, ipNet := range ipNets {
+			if !containsIpNet(whiteList, ipNet) {
+				whiteList = append(whiteList, ipNet)
+			}
+		}
+		return whiteList
+	})
+}
+
+func (pl *pinggyListener) RemoveIpWhiteList(ipNets ...*net.IPNet) error {
+	return pl.updateIpWhiteList(ipNets, func(whiteList []*net.IPNet) []*net.IPNet {
+		updated := []*net.IPNet{}
+		for _, entry := range whiteList {
+			if !containsIpNet(ipNets, entry) {
+				updated = append(updated, entry)
+			}
+		}
+		return updated
+	})
+}
+
+func (pl *pinggyListener) SetIpWhiteList(ipNets []*net.IPNet) error {
+	return pl.updateIpWhiteList(ipNets, func([]*net.IPNet) []*net.IPNet {
+		return append([]*net.IPNet{}, ipNets...)
+	})
+}
+
+func (pl *pinggyListener) GetIpWhiteList() []*net.IPNet {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return append([]*net.IPNet{}, pl.conf.IpWhiteList...)
+}
+
+/*
+updateIpWhiteList applies the new whitelist by restarting the session. The
+reverse listener belongs to the ssh connection, so the tunnel and its url are
+kept. If the new session cannot be started, the previous whitelist is
+restored.
+*/
+func (pl *pinggyListener) updateIpWhiteList(ipNets []*net.IPNet, update func([]*net.IPNet) []*net.IPNet) error {
+	cerr := &ConfigError{}
+	verifyWhiteList(cerr, ipNets)
+	if err := cerr.errOrNil(); err != nil {
+		return err
+	}
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.isClosed() {
+		return net.ErrClosed
+	}
+
+	old := pl.conf.IpWhiteList
+	pl.conf.IpWhiteList = update(append([]*net.IPNet{}, old...))
+	err := pl.restartSession()
+	if err != nil {
+		pl.conf.log.Error("failed to apply the ip whitelist, restoring the previous one", "err", err)
+		pl.conf.IpWhiteList = old
+		if rerr := pl.restartSession(); rerr != nil {
+			pl.conf.log.Error("failed to restore the ip whitelist", "err", rerr)
+		}
+		return err
+	}
+	pl.conf.log.Info("ip whitelist updated", "entries", len(pl.conf.IpWhiteList))
+
+	// Replayed when the tunnel gets re-established.
+	pl.conf.startSession = true
+	return nil
+}
+
+// restartSession expects pl.mu to be held.
+func (pl *pinggyListener) restartSession() error {
+	if pl.session != nil {
+		pl.session.Close()
+		pl.session = nil
+	}
+	return pl.startSession(pl.tunnel)
+}
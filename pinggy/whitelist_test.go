@@ -0,0 +1,178 @@
+package pinggy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWhiteListArg(t *testing.T) {
+	tests := []struct {
+		cidr string
+		arg  string
+	}{
+		{"10.0.0.0/8", "w:10.0.0.0/8"},
+		{"192.168.1.7/32", "w:192.168.1.7/32"},
+		{"2001:db8::/32", "w:2001:db8::/32"},
+		{"2001:db8::1/128", "w:2001:db8::1/128"},
+		{"::ffff:10.0.0.0/104", "w:10.0.0.0/8"},
+	}
+	for _, test := range tests {
+		_, ipNet, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arg := whiteListArg(ipNet); arg != test.arg {
+			t.Errorf("%s: expected %q, got %q", test.cidr, test.arg, arg)
+		}
+	}
+}
+
+func TestWhiteListArgNonCanonical(t *testing.T) {
+	tests := []struct {
+		ipNet *net.IPNet
+		arg   string
+	}{
+		// Host bits are kept, as they always were.
+		{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)}, "w:10.1.2.3/8"},
+		{&net.IPNet{IP: net.ParseIP("2001:db8:1::5"), Mask: net.CIDRMask(32, 128)}, "w:2001:db8:1::5/32"},
+	}
+	for _, test := range tests {
+		if arg := whiteListArg(test.ipNet); arg != test.arg {
+			t.Errorf("%s: expected %q, got %q", test.ipNet.IP, test.arg, arg)
+		}
+	}
+}
+
+func TestWhiteListCommand(t *testing.T) {
+	var whiteList []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whiteList = append(whiteList, ipNet)
+	}
+	if command := whiteListCommand(whiteList); command != " w:10.0.0.0/8 w:2001:db8::/32" {
+		t.Fatalf("unexpected command %q", command)
+	}
+	if command := whiteListCommand(nil); command != "" {
+		t.Fatalf("unexpected command %q", command)
+	}
+}
+
+func mustParseCidr(t *testing.T, cidr string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the host bits, as users may.
+	ipNet.IP = ip
+	return ipNet
+}
+
+func expectWhiteList(t *testing.T, pl *pinggyListener, expected ...string) {
+	t.Helper()
+	whiteList := []string{}
+	for _, ipNet := range pl.GetIpWhiteList() {
+		whiteList = append(whiteList, ipNet.String())
+	}
+	if strings.Join(whiteList, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected whitelist %v, got %v", expected, whiteList)
+	}
+}
+
+func expectCommands(t *testing.T, s *testServer, expected ...string) {
+	t.Helper()
+	if commands := s.sessionCommands(); strings.Join(commands, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected session commands %q, got %q", expected, commands)
+	}
+}
+
+func TestIpWhiteListUpdate(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{IpWhiteList: []*net.IPNet{mustParseCidr(t, "10.0.0.0/8")}})
+	expectCommands(t, s, " w:10.0.0.0/8")
+
+	// 10.1.2.3/8 is already present.
+	if err := pl.AddIpWhiteList(mustParseCidr(t, "2001:db8::1/32"), mustParseCidr(t, "10.1.2.3/8")); err != nil {
+		t.Fatal(err)
+	}
+	expectWhiteList(t, pl, "10.0.0.0/8", "2001:db8::1/32")
+
+	if err := pl.RemoveIpWhiteList(mustParseCidr(t, "10.9.9.9/8")); err != nil {
+		t.Fatal(err)
+	}
+	expectWhiteList(t, pl, "2001:db8::1/32")
+
+	if err := pl.SetIpWhiteList([]*net.IPNet{mustParseCidr(t, "192.168.1.7/32"), mustParseCidr(t, "10.0.0.0/8")}); err != nil {
+		t.Fatal(err)
+	}
+	expectWhiteList(t, pl, "192.168.1.7/32", "10.0.0.0/8")
+
+	if err := pl.SetIpWhiteList(nil); err != nil {
+		t.Fatal(err)
+	}
+	expectWhiteList(t, pl)
+
+	if err := pl.AddIpWhiteList(nil); err == nil {
+		t.Fatal("expected an error for a nil entry")
+	}
+
+	// Every change restarted the session on the same ssh connection.
+	expectCommands(t, s,
+		" w:10.0.0.0/8",
+		" w:10.0.0.0/8 w:2001:db8::1/32",
+		" w:2001:db8::1/32",
+		" w:192.168.1.7/32 w:10.0.0.0/8",
+		"shell",
+	)
+	if dials := s.dialCount(); dials != 1 {
+		t.Fatalf("expected a single ssh connection, got %d", dials)
+	}
+	if urls := pl.RemoteUrls(); len(urls) != 2 {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+}
+
+func TestIpWhiteListRestore(t *testing.T) {
+	s := newTestServer(t)
+	pl := s.connect(t, Config{})
+	expectCommands(t, s)
+
+	s.setFailExec(true)
+	if err := pl.AddIpWhiteList(mustParseCidr(t, "10.0.0.0/8")); err == nil {
+		t.Fatal("expected the session restart to fail")
+	}
+	expectWhiteList(t, pl)
+	// The previous session, a shell without whitelist, is restored.
+	expectCommands(t, s, " w:10.0.0.0/8", "shell")
+}
+
+func TestIpWhiteListReconnect(t *testing.T) {
+	s := newTestServer(t)
+	reconnected := make(chan []string, 1)
+	pl := s.connect(t, Config{Reconnect: &ReconnectConfig{
+		InitialBackoff: 10 * time.Millisecond,
+		OnReconnect: func(urls []string) {
+			reconnected <- urls
+		},
+	}})
+	if err := pl.AddIpWhiteList(mustParseCidr(t, "10.0.0.0/8")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := acceptAsync(pl)
+	s.dropAll()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	// The updated whitelist is applied to the new connection.
+	expectCommands(t, s, " w:10.0.0.0/8", " w:10.0.0.0/8")
+
+	pl.Close()
+	expectAccepted(t, accepted)
+}